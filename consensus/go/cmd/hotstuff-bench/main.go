@@ -0,0 +1,96 @@
+package main
+
+/* Sweep committee sizes and network delay distributions and write one CSV row per run.
+
+go run ./cmd/hotstuff-bench -variant basic,narwhal -cmdsize 512 -nodes 4,7,10 -delays constant:2ms,uniform:1ms:20ms,exp:1ms:5ms -dissemination direct,tree:3 -duration 10s -out basic.csv
+*/
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"learn/hotstuff"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var variantFlag = flag.String("variant", "basic", "comma separated consensus variants")
+var nodesFlag = flag.String("nodes", "4", "comma separated committee sizes")
+var delaysFlag = flag.String("delays", "constant:2ms", "comma separated delay distributions: constant:d, uniform:min:max, exp:base:mean, normal:mean:stddev")
+var disseminationFlag = flag.String("dissemination", "direct", "comma separated leader broadcast layers: direct, tree:fanout")
+var cmdSize = flag.Int("cmdsize", 0, "pad client commands to this many bytes")
+var batchSize = flag.Int("batch", hotstuff.DefaultMempool.BatchSize, "commands per mempool batch (narwhal variant)")
+var duration = flag.Duration("duration", 5*time.Second, "duration of each run")
+var out = flag.String("out", "", "csv file, stdout if empty")
+
+func main() {
+	flag.Parse()
+
+	var sizes []int
+	for _, s := range strings.Split(*nodesFlag, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sizes = append(sizes, n)
+	}
+	var dists []hotstuff.DelayDist
+	for _, s := range strings.Split(*delaysFlag, ",") {
+		d, err := hotstuff.ParseDelayDist(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dists = append(dists, d)
+	}
+
+	var layers []hotstuff.Disseminator
+	for _, s := range strings.Split(*disseminationFlag, ",") {
+		d, err := hotstuff.ParseDisseminator(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		layers = append(layers, d)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	writer := csv.NewWriter(w)
+	writer.Write(hotstuff.BenchCSVHeader())
+
+	hotstuff.Debug = false
+	hotstuff.DefaultMempool.BatchSize = *batchSize
+	for _, variant := range strings.Split(*variantFlag, ",") {
+		for _, n := range sizes {
+			for _, dist := range dists {
+				for _, layer := range layers {
+					r, err := hotstuff.RunBench(hotstuff.BenchConfig{
+						Variant:     variant,
+						Cluster:     hotstuff.ClusterConfig{Nodes: n, Leader: 0, DelayDist: dist, Dissemination: layer},
+						Duration:    *duration,
+						CommandSize: *cmdSize,
+					})
+					if err != nil {
+						log.Fatal(err)
+					}
+					writer.Write(r.CSVRecord())
+					writer.Flush()
+					fmt.Fprintf(os.Stderr, "%s n=%d %v %v: %.1f blocks/s %.1f cmds/s p50=%v p99=%v %.1f msgs/block, leader %.0f bytes/block\n",
+						variant, n, dist, layer, r.Throughput, r.CmdThroughput, r.P50, r.P99, r.MsgsPerBlock, r.LeaderBytesPerBlock)
+				}
+			}
+		}
+	}
+	if err := writer.Error(); err != nil {
+		log.Fatal(err)
+	}
+}
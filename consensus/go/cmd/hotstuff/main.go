@@ -0,0 +1,202 @@
+package main
+
+/* Launch a Basic HotStuff cluster from a config file and print committed blocks.
+Client commands are read line by line from stdin, or POSTed to /command if "http" is configured.
+
+	go run ./cmd/hotstuff -config cmd/hotstuff/cluster.json
+
+In "process" mode the launcher starts one child process per node (hotstuff -config ... -id i),
+the nodes talk over TCP on the configured addrs, and stdin is forwarded to the leader's process.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"learn/hotstuff"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var configFlag = flag.String("config", "cluster.json", "cluster config file")
+var idFlag = flag.Int("id", -1, "run only this node (process mode), -1 launches the whole cluster")
+
+type Config struct {
+	Nodes  int      `json:"nodes"`
+	Leader int      `json:"leader"`
+	Delay  string   `json:"delay"` // e.g. "2ms"
+	Mode   string   `json:"mode"`  // inprocess or process
+	Addrs  []string `json:"addrs"` // one tcp address per node, process mode only
+	HTTP   string   `json:"http"`  // optional address serving POST /command
+	// leader broadcast layer: direct (default) or tree:fanout
+	Dissemination string `json:"dissemination"`
+	// commands per mempool batch, 0 proposes commands inline instead of through the mempool
+	Batch int `json:"batch"`
+}
+
+func loadConfig(path string) (*Config, hotstuff.ClusterConfig, error) {
+	conf := &Config{Nodes: hotstuff.NumNodes, Delay: hotstuff.DefaultDelay.String(), Mode: "inprocess", Dissemination: "direct"}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, hotstuff.ClusterConfig{}, err
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, hotstuff.ClusterConfig{}, err
+	}
+	delay, err := time.ParseDuration(conf.Delay)
+	if err != nil {
+		return nil, hotstuff.ClusterConfig{}, err
+	}
+	if conf.Nodes < 4 {
+		return nil, hotstuff.ClusterConfig{}, fmt.Errorf("need at least 4 nodes to tolerate a fault, got %d", conf.Nodes)
+	}
+	if conf.Leader < 0 || conf.Leader >= conf.Nodes {
+		return nil, hotstuff.ClusterConfig{}, fmt.Errorf("leader %d out of range", conf.Leader)
+	}
+	dissemination, err := hotstuff.ParseDisseminator(conf.Dissemination)
+	if err != nil {
+		return nil, hotstuff.ClusterConfig{}, err
+	}
+	clusterConf := hotstuff.ClusterConfig{Nodes: conf.Nodes, Leader: conf.Leader, Delay: delay, Dissemination: dissemination}
+	if conf.Batch > 0 {
+		mempool := hotstuff.DefaultMempool
+		mempool.BatchSize = conf.Batch
+		clusterConf.Mempool = &mempool
+	}
+	return conf, clusterConf, nil
+}
+
+func main() {
+	flag.Parse()
+
+	conf, clusterConf, err := loadConfig(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cluster *hotstuff.Cluster
+	switch conf.Mode {
+	case "inprocess":
+		cluster = hotstuff.NewCluster(clusterConf)
+	case "process":
+		if *idFlag < 0 {
+			launch(conf)
+			return
+		}
+		cluster, err = hotstuff.JoinCluster(clusterConf, *idFlag, conf.Addrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown mode %q", conf.Mode)
+	}
+
+	cluster.Start()
+	defer cluster.Stop()
+
+	go func() {
+		for c := range cluster.Committed() {
+			fmt.Printf("COMMIT node=%d height=%d view=%d hash=%s cmds=%s\n",
+				c.Node, c.Block.Height, c.Block.View, c.Block.Hash, strings.Join(c.Commands, ","))
+		}
+	}()
+
+	// only the leader's process serves http in process mode, so the ports don't clash
+	if conf.HTTP != "" && (*idFlag < 0 || *idFlag == conf.Leader) {
+		go serveHTTP(conf.HTTP, cluster)
+	}
+	go readCommands(os.Stdin, cluster)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
+
+func readCommands(r io.Reader, cluster *hotstuff.Cluster) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd != "" {
+			cluster.Submit(cmd)
+		}
+	}
+}
+
+func serveHTTP(addr string, cluster *hotstuff.Cluster) {
+	http.HandleFunc("/command", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST a command", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd := strings.TrimSpace(string(body))
+		if cmd == "" {
+			http.Error(w, "empty command", http.StatusBadRequest)
+			return
+		}
+		cluster.Submit(cmd)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+// launch starts one child process per node and forwards stdin to the leader's process.
+func launch(conf *Config) {
+	var leaderStdin io.WriteCloser
+	var wg sync.WaitGroup
+	procs := make([]*exec.Cmd, conf.Nodes)
+	for i := 0; i < conf.Nodes; i++ {
+		cmd := exec.Command(os.Args[0], "-config", *configFlag, "-id", fmt.Sprint(i))
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.Stderr = cmd.Stdout
+		if i == conf.Leader {
+			if leaderStdin, err = cmd.StdinPipe(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := cmd.Start(); err != nil {
+			log.Fatal(err)
+		}
+		procs[i] = cmd
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				fmt.Printf("[proc %d] %s\n", i, scanner.Text())
+			}
+		}(i)
+	}
+
+	go func() {
+		io.Copy(leaderStdin, os.Stdin)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	for _, p := range procs {
+		p.Process.Signal(syscall.SIGTERM)
+	}
+	wg.Wait()
+	for _, p := range procs {
+		p.Wait()
+	}
+}
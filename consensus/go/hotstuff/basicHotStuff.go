@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,7 +24,7 @@ type SimpleNode struct {
 	// HotStuff state - reusing types from hotstuff.go
 	phase            Phase
 	blocks           map[int]*Block
-	uncommitedBlocks map[int]*Block // TODO: Use a hash-based key to avoid block overwrites in case of reorg; Sync blocks if these blocks are missing for the node
+	uncommitedBlocks map[string]*Block // by hash, competing blocks at a height don't overwrite each other. TODO: Sync blocks if these blocks are missing for the node
 	lockedQC         *QC
 	prepareQC        *QC
 
@@ -50,8 +51,16 @@ type SimpleNode struct {
 	preCommitCh     chan *Block
 	commitCh        chan *Block
 	decideCh        chan *Block
-	// simulate networkDelay
-	delay time.Duration
+	// simulate networkDelay, delayDist overrides delay if set
+	delay     time.Duration
+	delayDist DelayDist
+	// leader broadcasts go through dissemination, DirectBroadcast by default
+	dissemination Disseminator
+	// number of messages sent including votes, and bytes of the broadcast and relayed ones
+	sent      atomic.Int64
+	sentBytes atomic.Int64
+	// pending client commands, nil means leaders propose placeholder commands
+	cmdCh chan string
 
 	// Configuration
 	threshold  int
@@ -73,13 +82,33 @@ const (
 	Timeout      = 4 * NetDelay
 )
 
+// Debug enables the per-message trace, disable it when benchmarking.
+var Debug = true
+
+func debugf(format string, a ...interface{}) {
+	if Debug {
+		fmt.Printf(format, a...)
+	}
+}
+
 func NewSimpleNode(id int, leader *BasicLeaderConf) *SimpleNode {
+	return NewSimpleNodeWithSize(id, leader, NumNodes)
+}
+
+// quorumSize returns 2f+1 for a committee of size nodes, where n >= 3f+1.
+func quorumSize(size int) int {
+	f := (size - 1) / 3
+	return 2*f + 1
+}
+
+// NewSimpleNodeWithSize creates a node taking part in a committee of size nodes.
+func NewSimpleNodeWithSize(id int, leader *BasicLeaderConf, size int) *SimpleNode {
 	node := &SimpleNode{
 		ID:                  id,
 		view:                1,
 		phase:               NewView,
 		blocks:              make(map[int]*Block),
-		uncommitedBlocks:    make(map[int]*Block),
+		uncommitedBlocks:    make(map[string]*Block),
 		votes:               make(map[int]bool),
 		newViewMsgs:         make(map[int][]Message),
 		msgCh:               make(chan Message, 100),
@@ -91,10 +120,11 @@ func NewSimpleNode(id int, leader *BasicLeaderConf) *SimpleNode {
 		commitCh:            make(chan *Block, 100),
 		decideCh:            make(chan *Block, 100),
 		delay:               time.Duration(DefaultDelay),
-		threshold:           QuorumSize,
+		threshold:           quorumSize(size),
 		newViewTimeoutTimer: time.NewTimer(Timeout),
 		dead:                false,
 		leaderConf:          leader,
+		dissemination:       DirectBroadcast{},
 	}
 	// Initialize genesis block and highQC
 	genesis := &Block{
@@ -107,11 +137,12 @@ func NewSimpleNode(id int, leader *BasicLeaderConf) *SimpleNode {
 	}
 	node.blocks[0] = genesis
 	node.prepareQC = &QC{
-		Type:  Prepare,
-		View:  0,
-		Block: 0,
+		Type:      Prepare,
+		View:      0,
+		Block:     0,
+		BlockHash: genesis.Hash,
 	}
-	for i := 0; i < NumNodes; i++ {
+	for i := 0; i < size; i++ {
 		node.prepareQC.Signers = append(node.prepareQC.Signers, i)
 	}
 	return node
@@ -143,24 +174,42 @@ func (n *SimpleNode) blockHash(block *Block) string {
 
 func (n *SimpleNode) createBlock(parent *Block, command string, justify *QC) *Block {
 	block := &Block{
-		Height:   parent.Height + 1,
-		Parent:   parent.Height,
-		Command:  command,
-		Proposer: n.ID,
-		View:     n.view,
-		Justify:  justify,
+		Height:     parent.Height + 1,
+		Parent:     parent.Height,
+		ParentHash: parent.Hash,
+		Command:    command,
+		Proposer:   n.ID,
+		View:       n.view,
+		Justify:    justify,
 	}
 	block.Hash = n.blockHash(block)
 	return block
 }
 
-func (n *SimpleNode) extends(block *Block, ancestor int) bool {
-	current := block
-	parent, exists := n.blocks[current.Parent]
-	if !exists || parent.Height != ancestor {
+// lookup returns the block with hash at height, committed or not.
+func (n *SimpleNode) lookup(hash string, height int) (*Block, bool) {
+	if block, exists := n.uncommitedBlocks[hash]; exists {
+		return block, true
+	}
+	block, exists := n.blocks[height]
+	return block, exists && block != nil && block.Hash == hash
+}
+
+// extends tells whether block descends from the block qc certifies.
+func (n *SimpleNode) extends(block *Block, qc *QC) bool {
+	if block.Height <= qc.Block {
 		return false
 	}
-	return current != nil
+	// walk down the parents by hash, the locked block may not be committed yet
+	current := block
+	for current.Height > qc.Block {
+		parent, exists := n.lookup(current.ParentHash, current.Parent)
+		if !exists {
+			return false
+		}
+		current = parent
+	}
+	return current.Hash == qc.BlockHash
 }
 
 func (n *SimpleNode) safetyRule(block *Block, qc *QC) bool {
@@ -169,7 +218,7 @@ func (n *SimpleNode) safetyRule(block *Block, qc *QC) bool {
 	if n.lockedQC == nil {
 		return true
 	}
-	if n.extends(block, n.lockedQC.Block) {
+	if n.extends(block, n.lockedQC) {
 		return true
 	}
 	if qc != nil && qc.View > n.lockedQC.View {
@@ -179,21 +228,37 @@ func (n *SimpleNode) safetyRule(block *Block, qc *QC) bool {
 }
 
 func (n *SimpleNode) commit(block *Block) {
-	fmt.Printf("[Node %d] Committing block %v (cmd: %s)\n", n.ID, block.Height, block.Command)
+	debugf("[Node %d] Committing block %v (cmd: %s)\n", n.ID, block.Height, block.Command)
 
 	// Add block to local storage
 	currentHeight := n.blocks[len(n.blocks)-1].Height
-	for h := currentHeight + 1; h <= block.Height; h++ {
-		// TODO: sync blocks if the node doesn't have the block
-		n.blocks[h] = n.uncommitedBlocks[h]
-		delete(n.uncommitedBlocks, h)
+	if block.Height <= currentHeight {
+		return
+	}
+	// the branch of block down to the committed blocks, nil where the node doesn't have a block
+	// TODO: sync blocks if the node doesn't have the block
+	branch := make([]*Block, block.Height-currentHeight)
+	for b := block; b != nil && b.Height > currentHeight; b = n.uncommitedBlocks[b.ParentHash] {
+		branch[b.Height-currentHeight-1] = b
+	}
+	for i, committed := range branch {
+		n.blocks[currentHeight+1+i] = committed
 
-		n.decideCh <- block
+		// report every committed block once, not just the decided one, so its command isn't lost
+		if committed != nil {
+			n.decideCh <- committed
+		}
+	}
+	// the committed blocks and the forks they abandoned
+	for hash, b := range n.uncommitedBlocks {
+		if b.Height <= block.Height {
+			delete(n.uncommitedBlocks, hash)
+		}
 	}
 }
 
 func (n *SimpleNode) onPrepare(msg Message, allNodes []*SimpleNode) {
-	fmt.Printf("[Node %d] onPrepare %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
+	debugf("[Node %d] onPrepare %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -213,21 +278,21 @@ func (n *SimpleNode) onPrepare(msg Message, allNodes []*SimpleNode) {
 	// Update timer
 	n.newViewTimeoutTimer.Reset(Timeout)
 	n.lastUpdate = time.Now()
-	n.uncommitedBlocks[msg.Block.Height] = msg.Block
+	n.uncommitedBlocks[msg.Block.Hash] = msg.Block
 
 	// Send vote to leader
 	vote := Vote{
-		Type:   Prepare,
-		View:   msg.View,
-		Block:  msg.Block.Height,
-		Sender: n.ID,
+		Type:      Prepare,
+		View:      msg.View,
+		Block:     msg.Block.Height,
+		BlockHash: msg.Block.Hash,
+		Sender:    n.ID,
 	}
 
 	leaderID := n.leader(msg.View)
 	n.prepareCh <- msg.Block
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
+	n.sent.Add(1)
 	go func() {
 		allNodes[leaderID].voteCh <- vote
 	}()
@@ -238,7 +303,7 @@ func (n *SimpleNode) matchingQC(qc *QC, qcType Phase) bool {
 }
 
 func (n *SimpleNode) onPreCommit(msg Message, allNodes []*SimpleNode) {
-	fmt.Printf("[Node %d] onPreCommit %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
+	debugf("[Node %d] onPreCommit %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -254,10 +319,11 @@ func (n *SimpleNode) onPreCommit(msg Message, allNodes []*SimpleNode) {
 
 	// Send vote
 	vote := Vote{
-		Type:   PreCommit,
-		View:   msg.View,
-		Block:  msg.Block.Height,
-		Sender: n.ID,
+		Type:      PreCommit,
+		View:      msg.View,
+		Block:     msg.Block.Height,
+		BlockHash: msg.Block.Hash,
+		Sender:    n.ID,
 	}
 
 	leaderID := n.leader(msg.View)
@@ -265,17 +331,16 @@ func (n *SimpleNode) onPreCommit(msg Message, allNodes []*SimpleNode) {
 	if n.precommitSyncCh != nil {
 		<-n.precommitSyncCh
 	}
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
 
+	n.sent.Add(1)
 	go func() {
 		allNodes[leaderID].voteCh <- vote
 	}()
 }
 
 func (n *SimpleNode) onCommit(msg Message, allNodes []*SimpleNode) {
-	fmt.Printf("[Node %d] onCommit %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
+	debugf("[Node %d] onCommit %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -288,15 +353,18 @@ func (n *SimpleNode) onCommit(msg Message, allNodes []*SimpleNode) {
 	// Update timer
 	n.newViewTimeoutTimer.Reset(Timeout)
 	n.lastUpdate = time.Now()
-	// Process justify QC
+	// Process justify QC, lock on the precommitQC as in the Commit phase of the paper,
+	// otherwise replicas that missed Decide would vote for a block conflicting with a committed one.
 	n.prepareQC = msg.Justify
+	n.lockedQC = msg.Justify
 
 	// Send vote
 	vote := Vote{
-		Type:   Commit,
-		View:   msg.View,
-		Block:  msg.Block.Height,
-		Sender: n.ID,
+		Type:      Commit,
+		View:      msg.View,
+		Block:     msg.Block.Height,
+		BlockHash: msg.Block.Hash,
+		Sender:    n.ID,
 	}
 
 	leaderID := n.leader(msg.View)
@@ -304,16 +372,15 @@ func (n *SimpleNode) onCommit(msg Message, allNodes []*SimpleNode) {
 	if n.commitSyncCh != nil {
 		<-n.commitSyncCh
 	}
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
+	n.sent.Add(1)
 	go func() {
 		allNodes[leaderID].voteCh <- vote
 	}()
 }
 
 func (n *SimpleNode) onDecideQC(msg Message, allNodes []*SimpleNode) {
-	fmt.Printf("[Node %d] onDecideQC %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
+	debugf("[Node %d] onDecideQC %v onView:%v from [leader:%v]\n", n.ID, msg, n.view, msg.Sender)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -332,9 +399,7 @@ func (n *SimpleNode) onDecideQC(msg Message, allNodes []*SimpleNode) {
 	n.commit(msg.Block)
 
 	// Send block to decideCh for external tracking
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
 	// Advance to next view and send newview to next leader
 	n.view++
 	n.phase = NewView
@@ -349,15 +414,16 @@ func (n *SimpleNode) onDecideQC(msg Message, allNodes []*SimpleNode) {
 
 	// Send newview to new leader
 	newLeaderID := n.leader(n.view)
+	n.sent.Add(1)
 	go func() {
 		allNodes[newLeaderID].msgCh <- newViewMsg
 	}()
 
-	fmt.Printf("[Node %d] Committed block %v and advanced to view %d\n", n.ID, msg.Block.Height, n.view)
+	debugf("[Node %d] Committed block %v and advanced to view %d\n", n.ID, msg.Block.Height, n.view)
 }
 
 func (n *SimpleNode) onNewView(msg Message, allNodes []*SimpleNode) {
-	fmt.Printf("[Leader %d] onNewView %v onView:%v from [peer:%v]\n", n.ID, msg, n.view, msg.Sender)
+	debugf("[Leader %d] onNewView %v onView:%v from [peer:%v]\n", n.ID, msg, n.view, msg.Sender)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -385,7 +451,7 @@ func (n *SimpleNode) onNewView(msg Message, allNodes []*SimpleNode) {
 		// Add this newview message
 		n.newViewMsgs[msg.View] = append(n.newViewMsgs[msg.View], msg)
 
-		fmt.Printf("[Leader %d] Received NewView from Node %d for view %d (%d/%d)\n",
+		debugf("[Leader %d] Received NewView from Node %d for view %d (%d/%d)\n",
 			n.ID, msg.Sender, msg.View, len(n.newViewMsgs[msg.View]), n.threshold)
 
 		// Check if we have enough newview messages, including leader itself
@@ -420,19 +486,15 @@ func (n *SimpleNode) startNewViewConsensus(view int, allNodes []*SimpleNode) {
 	// Create new block
 	parent := n.blocks[0]
 	if highestQC != nil {
-		if block, exists := n.uncommitedBlocks[highestQC.Block]; exists {
+		if block, exists := n.lookup(highestQC.BlockHash, highestQC.Block); exists {
 			parent = block
-		} else {
-			if block, exists := n.blocks[highestQC.Block]; exists {
-				parent = block
-			}
 		}
 	}
-	fmt.Printf("[Leader %d] Starting new view %d with highQC view: %v, bn: %v\n", n.ID, view, highestQC.View, parent.Height)
+	debugf("[Leader %d] Starting new view %d with highQC view: %v, bn: %v\n", n.ID, view, highestQC.View, parent.Height)
 
-	command := fmt.Sprintf("new-cmd-%d", view)
+	command := n.nextCommand(view)
 	newBlock := n.createBlock(parent, command, highestQC)
-	n.uncommitedBlocks[newBlock.Height] = newBlock
+	n.uncommitedBlocks[newBlock.Hash] = newBlock
 
 	// Broadcast prepare message
 	prepareMsg := Message{
@@ -443,40 +505,82 @@ func (n *SimpleNode) startNewViewConsensus(view int, allNodes []*SimpleNode) {
 		Sender:  n.ID,
 	}
 
-	fmt.Printf("[Leader %d] Starting new view %d with block %v\n", n.ID, view, newBlock.Height)
-	fmt.Printf("\n---------- View %d: Leader %d proposes ----------\n", n.view, n.ID)
+	debugf("[Leader %d] Starting new view %d with block %v\n", n.ID, view, newBlock.Height)
+	debugf("\n---------- View %d: Leader %d proposes ----------\n", n.view, n.ID)
 	n.newViewCh <- newBlock
 	<-n.syncCh
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
 	n.broadcast(prepareMsg, allNodes)
 }
 
+// sleep simulates the network delay before a message leaves the node.
+func (n *SimpleNode) sleep() {
+	delay := n.delay
+	if n.delayDist != nil {
+		delay = n.delayDist.Sample()
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// nextCommand pops a pending client command if there is one, otherwise the leader proposes a placeholder command.
+func (n *SimpleNode) nextCommand(view int) string {
+	select {
+	case cmd := <-n.cmdCh:
+		return cmd
+	default:
+		return fmt.Sprintf("new-cmd-%d", view)
+	}
+}
+
 func (n *SimpleNode) broadcast(msg Message, allNodes []*SimpleNode) {
-	for i, node := range allNodes {
-		if i != n.ID {
-			go func(node *SimpleNode) {
-				node.msgCh <- msg
-			}(node)
-		}
+	targets := n.dissemination.Targets(n.ID, n.ID, len(allNodes), msg.View)
+	n.countSent(msg, len(targets))
+	for _, i := range targets {
+		go func(node *SimpleNode) {
+			node.msgCh <- msg
+		}(allNodes[i])
 	}
 }
 
-func (n *SimpleNode) onQuorum(view int, blockNumber int, allNodes []*SimpleNode) {
+// relay forwards a leader's broadcast to this node's children in the dissemination tree, if any.
+func (n *SimpleNode) relay(msg Message, allNodes []*SimpleNode) {
+	targets := n.dissemination.Targets(msg.Sender, n.ID, len(allNodes), msg.View)
+	if len(targets) == 0 {
+		return
+	}
+	n.countSent(msg, len(targets))
+	for _, i := range targets {
+		go func(node *SimpleNode) {
+			// one more network hop
+			n.sleep()
+			node.msgCh <- msg
+		}(allNodes[i])
+	}
+}
+
+func (n *SimpleNode) countSent(msg Message, copies int) {
+	data, _ := json.Marshal(msg)
+	n.sent.Add(int64(copies))
+	n.sentBytes.Add(int64(copies * len(data)))
+}
+
+func (n *SimpleNode) onQuorum(view int, blockHash string, allNodes []*SimpleNode) {
 	n.lastUpdate = time.Now()
 
-	fmt.Printf("[Leader %d] onQuorum phase:%v, onView:%v\n", n.ID, n.phase, n.view)
-	block := n.uncommitedBlocks[blockNumber]
+	debugf("[Leader %d] onQuorum phase:%v, onView:%v\n", n.ID, n.phase, n.view)
+	block := n.uncommitedBlocks[blockHash]
 	if block == nil {
 		panic("block not exists")
 	}
 	// Create QC - collect signers from those who voted
 	qc := &QC{
-		Type:    n.phase,
-		View:    view,
-		Block:   blockNumber,
-		Signers: make([]int, 0),
+		Type:      n.phase,
+		View:      view,
+		Block:     block.Height,
+		BlockHash: block.Hash,
+		Signers:   make([]int, 0),
 	}
 
 	// Add leader's signature
@@ -505,6 +609,7 @@ func (n *SimpleNode) onQuorum(view int, blockNumber int, allNodes []*SimpleNode)
 		n.phase = Commit
 		nextPhase = n.phase
 		n.prepareQC = qc
+		n.lockedQC = qc
 	case Commit:
 		// Send commitQC to followers so they can commit the block
 		nextPhase = Decide
@@ -522,10 +627,8 @@ func (n *SimpleNode) onQuorum(view int, blockNumber int, allNodes []*SimpleNode)
 		Justify: qc,
 		Sender:  n.ID,
 	}
-	fmt.Printf("[Leader %d] Broadcasting [Phase:%v] for block %v\n", n.ID, nextPhase, block.Height)
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	debugf("[Leader %d] Broadcasting [Phase:%v] for block %v\n", n.ID, nextPhase, block.Height)
+	n.sleep()
 	n.broadcast(msg, allNodes)
 }
 
@@ -537,7 +640,7 @@ func (n *SimpleNode) onTimeout(allNodes []*SimpleNode) {
 		return
 	}
 
-	fmt.Printf("[Node %d] Timeout in view %d, advancing to view %d\n", n.ID, n.view, n.view+1)
+	debugf("[Node %d] Timeout in view %d, advancing to view %d\n", n.ID, n.view, n.view+1)
 
 	// Advance view
 	n.view++
@@ -570,6 +673,7 @@ func (n *SimpleNode) onTimeout(allNodes []*SimpleNode) {
 			n.newViewMsgs[n.view] = append(n.newViewMsgs[n.view], newViewMsg)
 		}
 	} else {
+		n.sent.Add(1)
 		go func() {
 			allNodes[newLeaderID].msgCh <- newViewMsg
 		}()
@@ -594,7 +698,7 @@ func (n *SimpleNode) proposeBlock(command string, allNodes []*SimpleNode) {
 
 	// Create new block
 	newBlock := n.createBlock(parent, command, n.prepareQC)
-	n.uncommitedBlocks[newBlock.Height] = newBlock
+	n.uncommitedBlocks[newBlock.Hash] = newBlock
 	n.phase = Prepare
 
 	// Broadcast prepare message
@@ -606,11 +710,9 @@ func (n *SimpleNode) proposeBlock(command string, allNodes []*SimpleNode) {
 		Sender:  n.ID,
 	}
 
-	fmt.Printf("[Leader %d] Proposing block %v with command '%s' at view %d\n",
+	debugf("[Leader %d] Proposing block %v with command '%s' at view %d\n",
 		n.ID, newBlock.Height, command, n.view)
-	if n.delay > 0 {
-		time.Sleep(n.delay)
-	}
+	n.sleep()
 	n.broadcast(prepareMsg, allNodes)
 }
 
@@ -620,6 +722,9 @@ func (n *SimpleNode) runConsensus(allNodes []*SimpleNode, wg *sync.WaitGroup) {
 	for !n.dead {
 		select {
 		case msg := <-n.msgCh:
+			if msg.Type != NewView {
+				n.relay(msg, allNodes)
+			}
 			switch msg.Type {
 			case NewView:
 				n.onNewView(msg, allNodes)
@@ -637,7 +742,7 @@ func (n *SimpleNode) runConsensus(allNodes []*SimpleNode, wg *sync.WaitGroup) {
 			{
 				n.mu.Lock()
 				if n.isLeader(vote.View) && vote.View == n.view && vote.Type == n.phase {
-					fmt.Printf("[Leader %d] gotVote %v onView:%v, onPhase:%v, from [peer:%v]\n", n.ID, vote, n.view, n.phase, vote.Sender)
+					debugf("[Leader %d] gotVote %v onView:%v, onPhase:%v, from [peer:%v]\n", n.ID, vote, n.view, n.phase, vote.Sender)
 
 					// Check if this node already voted in current phase - prevent duplicate voting
 					if n.votes[vote.Sender] {
@@ -658,7 +763,7 @@ func (n *SimpleNode) runConsensus(allNodes []*SimpleNode, wg *sync.WaitGroup) {
 
 					// Check if we have enough votes (including leader's implicit vote)
 					if voteCount+1 >= n.threshold { // +1 for leader's implicit vote
-						n.onQuorum(vote.View, vote.Block, allNodes)
+						n.onQuorum(vote.View, vote.BlockHash, allNodes)
 					}
 				}
 				n.mu.Unlock()
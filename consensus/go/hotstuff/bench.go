@@ -0,0 +1,193 @@
+package hotstuff
+
+/* Benchmark consensus variants in-process.
+A run drives a fresh cluster for a fixed duration with a saturated command queue and measures, at the leader:
+- throughput: committed blocks and client commands per second
+- commit latency: from the leader releasing a proposal to the leader committing it
+- messages per committed block: every message sent by any node, votes and newViews included
+- leader bandwidth: messages and broadcast bytes sent by the leader per committed block
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Protocol is a consensus variant the benchmark can drive, *Cluster implements it for Basic HotStuff.
+type Protocol interface {
+	Start()
+	Stop()
+	Submit(cmd string)
+	Committed() <-chan Committed
+	Messages() int64
+	NodeSent(id int) (msgs int64, bytes int64)
+}
+
+// DefaultMempool is used by the narwhal variant unless the cluster config sets one.
+var DefaultMempool = MempoolConfig{BatchSize: 100, BatchTimeout: 10 * time.Millisecond, MaxInflight: 4}
+
+// Variants maps a variant name to the constructor of an in-process cluster.
+var Variants = map[string]func(ClusterConfig) Protocol{
+	"basic": func(conf ClusterConfig) Protocol { return NewCluster(conf) },
+	// Basic HotStuff ordering the certificates of a Narwhal-style mempool
+	"narwhal": func(conf ClusterConfig) Protocol {
+		if conf.Mempool == nil {
+			mempool := DefaultMempool
+			conf.Mempool = &mempool
+		}
+		return NewCluster(conf)
+	},
+}
+
+type BenchConfig struct {
+	Variant     string
+	Cluster     ClusterConfig
+	Duration    time.Duration
+	CommandSize int // client commands are padded to this many bytes
+}
+
+const benchCmdPrefix = "bench-cmd-"
+
+type BenchResult struct {
+	BenchConfig
+	Blocks        int
+	Throughput    float64 // blocks/s
+	Commands      int
+	CmdThroughput float64 // commands/s
+	P50           time.Duration
+	P90           time.Duration
+	P99           time.Duration
+	Max           time.Duration
+	Messages      int64
+	MsgsPerBlock  float64
+
+	LeaderMsgsPerBlock  float64
+	LeaderBytesPerBlock float64
+}
+
+func RunBench(conf BenchConfig) (*BenchResult, error) {
+	newProtocol, ok := Variants[conf.Variant]
+	if !ok {
+		return nil, fmt.Errorf("unknown variant %q", conf.Variant)
+	}
+	p := newProtocol(conf.Cluster)
+	p.Start()
+
+	// keep the leader busy with real commands
+	stop := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				cmd := fmt.Sprintf("%s%d-", benchCmdPrefix, i)
+				if pad := conf.CommandSize - len(cmd); pad > 0 {
+					cmd += strings.Repeat("x", pad)
+				}
+				p.Submit(cmd)
+			}
+		}
+	}()
+
+	var latencies []time.Duration
+	commands := 0
+	heights := make(map[int]bool)
+	deadline := time.After(conf.Duration)
+	start := time.Now()
+loop:
+	for {
+		select {
+		case c := <-p.Committed():
+			if c.Node != conf.Cluster.Leader || heights[c.Block.Height] {
+				continue
+			}
+			heights[c.Block.Height] = true
+			for _, cmd := range c.Commands {
+				// placeholder commands proposed while the queue is empty don't count
+				if strings.HasPrefix(cmd, benchCmdPrefix) {
+					commands++
+				}
+			}
+			if !c.Proposed.IsZero() {
+				latencies = append(latencies, time.Since(c.Proposed))
+			}
+		case <-deadline:
+			break loop
+		}
+	}
+	elapsed := time.Since(start)
+	messages := p.Messages()
+	leaderMsgs, leaderBytes := p.NodeSent(conf.Cluster.Leader)
+	close(stop)
+	p.Stop()
+
+	r := &BenchResult{
+		BenchConfig:   conf,
+		Blocks:        len(heights),
+		Throughput:    float64(len(heights)) / elapsed.Seconds(),
+		Commands:      commands,
+		CmdThroughput: float64(commands) / elapsed.Seconds(),
+		Messages:      messages,
+	}
+	if r.Blocks > 0 {
+		r.MsgsPerBlock = float64(messages) / float64(r.Blocks)
+		r.LeaderMsgsPerBlock = float64(leaderMsgs) / float64(r.Blocks)
+		r.LeaderBytesPerBlock = float64(leaderBytes) / float64(r.Blocks)
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.P50 = percentile(latencies, 0.50)
+		r.P90 = percentile(latencies, 0.90)
+		r.P99 = percentile(latencies, 0.99)
+		r.Max = latencies[len(latencies)-1]
+	}
+	return r, nil
+}
+
+// percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func (r *BenchResult) delay() string {
+	if r.Cluster.DelayDist != nil {
+		return r.Cluster.DelayDist.String()
+	}
+	return ConstantDelay{r.Cluster.Delay}.String()
+}
+
+func (r *BenchResult) dissemination() string {
+	if r.Cluster.Dissemination != nil {
+		return r.Cluster.Dissemination.String()
+	}
+	return DirectBroadcast{}.String()
+}
+
+func BenchCSVHeader() []string {
+	return []string{"variant", "nodes", "delay", "dissemination", "cmd_size", "duration_s", "blocks", "throughput_bps", "cmds", "throughput_cps",
+		"p50_ms", "p90_ms", "p99_ms", "max_ms", "messages", "msgs_per_block", "leader_msgs_per_block", "leader_bytes_per_block"}
+}
+
+func (r *BenchResult) CSVRecord() []string {
+	ms := func(d time.Duration) string { return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond)) }
+	return []string{
+		r.Variant,
+		fmt.Sprint(r.Cluster.Nodes),
+		r.delay(),
+		r.dissemination(),
+		fmt.Sprint(r.CommandSize),
+		fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		fmt.Sprint(r.Blocks),
+		fmt.Sprintf("%.3f", r.Throughput),
+		fmt.Sprint(r.Commands),
+		fmt.Sprintf("%.3f", r.CmdThroughput),
+		ms(r.P50), ms(r.P90), ms(r.P99), ms(r.Max),
+		fmt.Sprint(r.Messages),
+		fmt.Sprintf("%.3f", r.MsgsPerBlock),
+		fmt.Sprintf("%.3f", r.LeaderMsgsPerBlock),
+		fmt.Sprintf("%.3f", r.LeaderBytesPerBlock),
+	}
+}
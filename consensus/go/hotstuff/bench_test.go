@@ -0,0 +1,36 @@
+package hotstuff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunBench(t *testing.T) {
+	r, err := RunBench(BenchConfig{
+		Variant:  "basic",
+		Cluster:  ClusterConfig{Nodes: NumNodes, Leader: 0, DelayDist: UniformDelay{time.Millisecond, 3 * time.Millisecond}},
+		Duration: 500 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.Greater(t, r.Blocks, 0)
+	assert.Greater(t, r.MsgsPerBlock, 0.0)
+	assert.LessOrEqual(t, r.P50, r.P99)
+	assert.Len(t, r.CSVRecord(), len(BenchCSVHeader()))
+
+	_, err = RunBench(BenchConfig{Variant: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestParseDelayDist(t *testing.T) {
+	for _, s := range []string{"constant:2ms", "uniform:1ms:5ms", "exp:1ms:2ms", "normal:5ms:1ms"} {
+		d, err := ParseDelayDist(s)
+		assert.NoError(t, err)
+		assert.Equal(t, s, d.String())
+	}
+	for _, s := range []string{"constant", "uniform:5ms:1ms", "exp:1ms", "zipf:1ms:1ms"} {
+		_, err := ParseDelayDist(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,225 @@
+package hotstuff
+
+/* Run a Basic HotStuff cluster outside of go test.
+A Cluster owns the nodes running in this process and plays the role the tests play in basicHotStuff_test.go:
+it drains the per-phase channels, releases the leader through syncCh and reports every committed block.
+In-process clusters run all nodes; a process node (see transport.go) runs one node and reaches its peers over TCP.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+type ClusterConfig struct {
+	Nodes  int           // committee size, n >= 3f+1
+	Leader int           // fixed leader id
+	Delay  time.Duration // simulated processing delay per phase
+	// DelayDist overrides Delay with a sampled delay per message if set
+	DelayDist DelayDist
+	// Dissemination of leader broadcasts, DirectBroadcast if nil
+	Dissemination Disseminator
+	// Mempool separates data availability from ordering if set, in-process clusters only
+	Mempool *MempoolConfig
+}
+
+// Committed is a block committed by node Node.
+type Committed struct {
+	Node     int
+	Block    *Block
+	Commands []string  // commands ordered by the block, resolved from the mempool if there is one
+	Proposed time.Time // zero if unknown, only reliable for the leader's commits
+}
+
+type Cluster struct {
+	conf       ClusterConfig
+	leaderConf *BasicLeaderConf
+	nodes      []*SimpleNode // every node of the committee, remote ones are stubs
+	local      []int         // ids of the nodes running in this process
+	cmdCh      chan string
+	commitCh   chan Committed
+	transport  *transport // nil for in-process clusters
+	mempool    *Mempool   // nil if commands are proposed inline
+
+	proposedMu sync.Mutex
+	proposed   map[string]time.Time // block hash -> time the leader released the proposal
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func newCluster(conf ClusterConfig, local []int) *Cluster {
+	leaderConf := &BasicLeaderConf{
+		LeaderID:     conf.Leader,
+		NextLeaderID: conf.Leader,
+	}
+	c := &Cluster{
+		conf:       conf,
+		leaderConf: leaderConf,
+		nodes:      make([]*SimpleNode, conf.Nodes),
+		local:      local,
+		cmdCh:      make(chan string, 1024),
+		commitCh:   make(chan Committed, 1024),
+		proposed:   make(map[string]time.Time),
+		done:       make(chan struct{}),
+	}
+	if conf.Mempool != nil {
+		// leaders take every certificate formed since their last proposal, see Mempool.offer
+		c.cmdCh = make(chan string)
+	}
+	for i := 0; i < conf.Nodes; i++ {
+		node := NewSimpleNodeWithSize(i, leaderConf, conf.Nodes)
+		node.delay = conf.Delay
+		node.delayDist = conf.DelayDist
+		if conf.Dissemination != nil {
+			node.dissemination = conf.Dissemination
+		}
+		node.cmdCh = c.cmdCh
+		c.nodes[i] = node
+	}
+	if conf.Mempool != nil {
+		c.mempool = NewMempool(*conf.Mempool, conf.Nodes, c.sampleDelay, c.cmdCh)
+	}
+	return c
+}
+
+func (c *Cluster) sampleDelay() time.Duration {
+	if c.conf.DelayDist != nil {
+		return c.conf.DelayDist.Sample()
+	}
+	return c.conf.Delay
+}
+
+// NewCluster creates a cluster running all conf.Nodes nodes in this process.
+func NewCluster(conf ClusterConfig) *Cluster {
+	local := make([]int, conf.Nodes)
+	for i := range local {
+		local[i] = i
+	}
+	return newCluster(conf, local)
+}
+
+func (c *Cluster) isLocal(id int) bool {
+	for _, i := range c.local {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Start runs the local nodes and lets the leader propose the first block if it is local.
+func (c *Cluster) Start() {
+	if c.mempool != nil {
+		c.mempool.Start()
+	}
+	for _, id := range c.local {
+		node := c.nodes[id]
+		c.wg.Add(1)
+		go node.runConsensus(c.nodes, &c.wg)
+		go c.drain(node)
+	}
+	leader := c.nodes[c.leaderConf.LeaderID]
+	if c.isLocal(leader.ID) {
+		go leader.proposeBlock(leader.nextCommand(1), c.nodes)
+	}
+}
+
+// drain consumes the channels the tests use to step a node, so the node never blocks on them.
+func (c *Cluster) drain(node *SimpleNode) {
+	for {
+		select {
+		case block := <-node.newViewCh:
+			c.proposedMu.Lock()
+			c.proposed[block.Hash] = time.Now()
+			c.proposedMu.Unlock()
+			// release the new leader so it broadcasts its proposal
+			select {
+			case node.syncCh <- 0:
+			case <-c.done:
+				return
+			}
+		case <-node.prepareCh:
+		case <-node.preCommitCh:
+		case <-node.commitCh:
+		case block := <-node.decideCh:
+			c.proposedMu.Lock()
+			proposed := c.proposed[block.Hash]
+			if node.ID == c.conf.Leader {
+				// the leader commits first, prune so the map stays bounded in soak runs
+				delete(c.proposed, block.Hash)
+			}
+			c.proposedMu.Unlock()
+			commands := []string{block.Command}
+			if c.mempool != nil {
+				var err error
+				if commands, err = c.mempool.Resolve(node.ID, block); err != nil {
+					debugf("[Node %d] failed to resolve block %v: %v\n", node.ID, block.Height, err)
+				}
+			}
+			select {
+			case c.commitCh <- Committed{Node: node.ID, Block: block, Commands: commands, Proposed: proposed}:
+			case <-c.done:
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Submit queues a client command for the leader, or for the mempool workers if there is a mempool.
+func (c *Cluster) Submit(cmd string) {
+	if c.mempool != nil {
+		c.mempool.Submit(cmd)
+		return
+	}
+	if !c.isLocal(c.leaderConf.LeaderID) && c.transport != nil {
+		c.transport.sendCommand(c.leaderConf.LeaderID, cmd)
+		return
+	}
+	select {
+	case c.cmdCh <- cmd:
+	case <-c.done:
+	}
+}
+
+// Committed returns the blocks committed by the local nodes.
+func (c *Cluster) Committed() <-chan Committed {
+	return c.commitCh
+}
+
+// Messages returns the number of messages sent by the local nodes so far, mempool traffic included.
+func (c *Cluster) Messages() int64 {
+	var sent int64
+	for _, id := range c.local {
+		sent += c.nodes[id].sent.Load()
+	}
+	if c.mempool != nil {
+		sent += c.mempool.Messages()
+	}
+	return sent
+}
+
+// NodeSent returns the messages sent by local node id and the bytes of the broadcasts among them.
+func (c *Cluster) NodeSent(id int) (msgs int64, bytes int64) {
+	return c.nodes[id].sent.Load(), c.nodes[id].sentBytes.Load()
+}
+
+// Stop kills the local nodes. Nodes blocked in the middle of a phase are not waited for.
+func (c *Cluster) Stop() {
+	for _, id := range c.local {
+		c.nodes[id].kill()
+	}
+	if c.mempool != nil {
+		c.mempool.Stop()
+	}
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	if c.transport != nil {
+		c.transport.close()
+	}
+}
@@ -0,0 +1,31 @@
+package hotstuff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterCommitsSubmittedCommand(t *testing.T) {
+	cluster := NewCluster(ClusterConfig{Nodes: NumNodes, Leader: 0, Delay: DefaultDelay})
+	cluster.Start()
+	defer cluster.Stop()
+	cluster.Submit("transfer-1")
+
+	committed := make(map[int]*Block)
+	deadline := time.After(10 * Timeout)
+	for len(committed) < NumNodes {
+		select {
+		case c := <-cluster.Committed():
+			if c.Block.Command == "transfer-1" {
+				committed[c.Node] = c.Block
+			}
+		case <-deadline:
+			t.Fatalf("command committed by %d/%d nodes", len(committed), NumNodes)
+		}
+	}
+	for _, block := range committed {
+		assert.Equal(t, committed[0].Hash, block.Hash)
+	}
+}
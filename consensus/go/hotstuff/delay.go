@@ -0,0 +1,88 @@
+package hotstuff
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DelayDist samples the simulated network delay of a message.
+type DelayDist interface {
+	Sample() time.Duration
+	String() string
+}
+
+type ConstantDelay struct {
+	D time.Duration
+}
+
+func (d ConstantDelay) Sample() time.Duration { return d.D }
+func (d ConstantDelay) String() string        { return fmt.Sprintf("constant:%v", d.D) }
+
+// UniformDelay samples uniformly from [Min, Max].
+type UniformDelay struct {
+	Min, Max time.Duration
+}
+
+func (d UniformDelay) Sample() time.Duration {
+	return d.Min + time.Duration(rand.Int63n(int64(d.Max-d.Min)+1))
+}
+func (d UniformDelay) String() string { return fmt.Sprintf("uniform:%v:%v", d.Min, d.Max) }
+
+// ExpDelay is Base plus an exponentially distributed tail with mean Mean, a rough model of a WAN with stragglers.
+type ExpDelay struct {
+	Base, Mean time.Duration
+}
+
+func (d ExpDelay) Sample() time.Duration {
+	return d.Base + time.Duration(rand.ExpFloat64()*float64(d.Mean))
+}
+func (d ExpDelay) String() string { return fmt.Sprintf("exp:%v:%v", d.Base, d.Mean) }
+
+// NormalDelay samples a normal distribution truncated at 0.
+type NormalDelay struct {
+	Mean, Stddev time.Duration
+}
+
+func (d NormalDelay) Sample() time.Duration {
+	v := rand.NormFloat64()*float64(d.Stddev) + float64(d.Mean)
+	return time.Duration(math.Max(v, 0))
+}
+func (d NormalDelay) String() string { return fmt.Sprintf("normal:%v:%v", d.Mean, d.Stddev) }
+
+// ParseDelayDist parses the String() form of a distribution, e.g. "constant:2ms", "uniform:1ms:5ms",
+// "exp:1ms:2ms" or "normal:5ms:1ms".
+func ParseDelayDist(s string) (DelayDist, error) {
+	parts := strings.Split(s, ":")
+	args := make([]time.Duration, len(parts)-1)
+	for i, p := range parts[1:] {
+		d, err := time.ParseDuration(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad delay distribution %q: %v", s, err)
+		}
+		args[i] = d
+	}
+	want := 2
+	if parts[0] == "constant" {
+		want = 1
+	}
+	if len(args) != want {
+		return nil, fmt.Errorf("bad delay distribution %q: %s takes %d durations", s, parts[0], want)
+	}
+	switch parts[0] {
+	case "constant":
+		return ConstantDelay{args[0]}, nil
+	case "uniform":
+		if args[1] < args[0] {
+			return nil, fmt.Errorf("bad delay distribution %q: max < min", s)
+		}
+		return UniformDelay{args[0], args[1]}, nil
+	case "exp":
+		return ExpDelay{args[0], args[1]}, nil
+	case "normal":
+		return NormalDelay{args[0], args[1]}, nil
+	}
+	return nil, fmt.Errorf("unknown delay distribution %q", parts[0])
+}
@@ -0,0 +1,100 @@
+package hotstuff
+
+/* Dissemination of leader broadcasts.
+DirectBroadcast is the original O(n) leader fan-out. TreeBroadcast relays proposals Turbine-style
+(see architecture/solana_turbine.md): the peers are shuffled per view into a complete Fanout-ary tree,
+the leader sends only to the first Fanout peers and every peer forwards to its children,
+so the leader sends Fanout messages instead of n-1 at the cost of log_Fanout(n) hops.
+Shuffling by view rotates the relay load, like Turbine shuffles the tree per shred.
+Votes and newViews still go straight to the leader.
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Disseminator decides who forwards a broadcast of origin to whom.
+type Disseminator interface {
+	// Targets returns the peers node me sends the broadcast of origin in view to,
+	// me == origin for the first hop. size is the committee size.
+	Targets(origin, me, size, view int) []int
+	String() string
+}
+
+type DirectBroadcast struct{}
+
+func (DirectBroadcast) Targets(origin, me, size, view int) []int {
+	if me != origin {
+		return nil
+	}
+	targets := make([]int, 0, size-1)
+	for i := 0; i < size; i++ {
+		if i != origin {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
+
+func (DirectBroadcast) String() string { return "direct" }
+
+type TreeBroadcast struct {
+	Fanout int
+}
+
+// order returns the peers of origin in tree order, the same on every node for a given view.
+func (t TreeBroadcast) order(origin, size, view int) []int {
+	perm := rand.New(rand.NewSource(int64(view))).Perm(size)
+	order := make([]int, 0, size-1)
+	for _, i := range perm {
+		if i != origin {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (t TreeBroadcast) Targets(origin, me, size, view int) []int {
+	order := t.order(origin, size, view)
+	// the origin is the virtual root whose children are order[0:Fanout],
+	// the children of order[i] are order[Fanout*(i+1) : Fanout*(i+2)]
+	first := 0
+	if me != origin {
+		pos := -1
+		for i, id := range order {
+			if id == me {
+				pos = i
+				break
+			}
+		}
+		if pos < 0 {
+			return nil
+		}
+		first = t.Fanout * (pos + 1)
+	}
+	var targets []int
+	for i := first; i < first+t.Fanout && i < len(order); i++ {
+		targets = append(targets, order[i])
+	}
+	return targets
+}
+
+func (t TreeBroadcast) String() string { return fmt.Sprintf("tree:%d", t.Fanout) }
+
+// ParseDisseminator parses the String() form of a disseminator: "direct" or "tree:fanout".
+func ParseDisseminator(s string) (Disseminator, error) {
+	if s == "direct" {
+		return DirectBroadcast{}, nil
+	}
+	if fanout, ok := strings.CutPrefix(s, "tree:"); ok {
+		f, err := strconv.Atoi(fanout)
+		if err != nil || f < 1 {
+			return nil, fmt.Errorf("bad tree fanout %q", fanout)
+		}
+		return TreeBroadcast{Fanout: f}, nil
+	}
+	return nil, fmt.Errorf("unknown dissemination %q", s)
+}
@@ -0,0 +1,67 @@
+package hotstuff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// every peer must receive a broadcast exactly once, whatever the view and the fanout
+func TestTreeBroadcastCoversCommittee(t *testing.T) {
+	for _, size := range []int{4, 7, 16, 31} {
+		for _, fanout := range []int{1, 2, 3, 8} {
+			tree := TreeBroadcast{Fanout: fanout}
+			for view := 0; view < 10; view++ {
+				origin := view % size
+				received := make(map[int]int)
+				queue := []int{origin}
+				for len(queue) > 0 {
+					me := queue[0]
+					queue = queue[1:]
+					for _, peer := range tree.Targets(origin, me, size, view) {
+						received[peer]++
+						queue = append(queue, peer)
+					}
+				}
+				assert.Len(t, received, size-1)
+				assert.Zero(t, received[origin])
+				for peer, n := range received {
+					assert.Equal(t, 1, n, "peer %d size %d fanout %d", peer, size, fanout)
+				}
+				assert.LessOrEqual(t, len(tree.Targets(origin, origin, size, view)), fanout)
+			}
+		}
+	}
+}
+
+func TestTreeBroadcastReducesLeaderBandwidth(t *testing.T) {
+	run := func(layer Disseminator) *BenchResult {
+		r, err := RunBench(BenchConfig{
+			Variant:  "basic",
+			Cluster:  ClusterConfig{Nodes: 13, Leader: 0, Delay: time.Millisecond, Dissemination: layer},
+			Duration: 500 * time.Millisecond,
+		})
+		assert.NoError(t, err)
+		assert.Greater(t, r.Blocks, 0)
+		return r
+	}
+	direct := run(DirectBroadcast{})
+	tree := run(TreeBroadcast{Fanout: 3})
+	t.Logf("leader bytes/block: direct %.0f, tree %.0f", direct.LeaderBytesPerBlock, tree.LeaderBytesPerBlock)
+	// 12 peers vs 3 relays per broadcast
+	assert.Less(t, tree.LeaderMsgsPerBlock, direct.LeaderMsgsPerBlock/2)
+	assert.Less(t, tree.LeaderBytesPerBlock, direct.LeaderBytesPerBlock/2)
+}
+
+func TestParseDisseminator(t *testing.T) {
+	for _, s := range []string{"direct", "tree:3"} {
+		d, err := ParseDisseminator(s)
+		assert.NoError(t, err)
+		assert.Equal(t, s, d.String())
+	}
+	for _, s := range []string{"tree", "tree:0", "gossip"} {
+		_, err := ParseDisseminator(s)
+		assert.Error(t, err, s)
+	}
+}
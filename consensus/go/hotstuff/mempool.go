@@ -0,0 +1,301 @@
+package hotstuff
+
+/* Narwhal-style mempool: separate data availability from ordering.
+Every node runs a worker that packs client commands into batches and broadcasts them to all nodes.
+A node that stored a batch acks it, and 2f+1 acks form an availability certificate: at least f+1 honest nodes hold the batch,
+so it can always be fetched later. Only certificates are handed to HotStuff: a block's Command lists the digests of
+all certificates formed since the previous proposal ("cert:<digest>,<digest>..."), so its size doesn't depend on
+how many commands the batches hold. On commit each digest is resolved from the local store, or fetched from one of
+the certificate's signers. A worker has at most MaxInflight uncertified batches, which is the backpressure towards
+clients when dissemination falls behind; certified batches wait for ordering without holding a slot. A batch is dropped from every store once all nodes resolved it.
+
+The mempool is simulated in-process like SimpleNode: stores are maps and every message sleeps a sampled network delay.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const certPrefix = "cert:"
+
+type MempoolConfig struct {
+	BatchSize    int           // commands per batch
+	BatchTimeout time.Duration // seal a partial batch after this long
+	MaxInflight  int           // batches per worker waiting to be certified
+}
+
+type Batch struct {
+	Worker   int      `json:"worker"`
+	Seq      int      `json:"seq"`
+	Commands []string `json:"commands"`
+}
+
+// Certificate proves that Signers stored the batch with digest Digest.
+type Certificate struct {
+	Digest  string `json:"digest"`
+	Worker  int    `json:"worker"`
+	Signers []int  `json:"signers"`
+}
+
+type batchStore struct {
+	mu      sync.Mutex
+	batches map[string]*Batch
+}
+
+type Mempool struct {
+	conf      MempoolConfig
+	size      int
+	threshold int
+	delay     func() time.Duration
+
+	stores    []*batchStore
+	inputs    []chan string // per worker
+	inflight  []chan struct{}
+	certsMu   sync.Mutex
+	certs     map[string]*Certificate
+	resolved  map[string]map[int]bool // digest -> nodes that committed it
+	certified chan string             // digests waiting to be proposed
+	ordered   chan string             // digest lists for the consensus leader, unbuffered so digests pile up between proposals
+	next      atomic.Int64
+	sent      atomic.Int64
+
+	done chan struct{}
+}
+
+// NewMempool creates the mempool of a committee of size nodes.
+// Certificates are offered on ordered as "cert:<digest>,<digest>...", ordered should be unbuffered.
+func NewMempool(conf MempoolConfig, size int, delay func() time.Duration, ordered chan string) *Mempool {
+	if conf.MaxInflight < 1 {
+		conf.MaxInflight = 1
+	}
+	m := &Mempool{
+		conf:      conf,
+		size:      size,
+		threshold: quorumSize(size),
+		delay:     delay,
+		stores:    make([]*batchStore, size),
+		inputs:    make([]chan string, size),
+		inflight:  make([]chan struct{}, size),
+		certs:     make(map[string]*Certificate),
+		resolved:  make(map[string]map[int]bool),
+		certified: make(chan string, size*conf.MaxInflight),
+		ordered:   ordered,
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		m.stores[i] = &batchStore{batches: make(map[string]*Batch)}
+		m.inputs[i] = make(chan string, 1024)
+		m.inflight[i] = make(chan struct{}, conf.MaxInflight)
+	}
+	return m
+}
+
+func (m *Mempool) Start() {
+	for i := 0; i < m.size; i++ {
+		go m.runWorker(i)
+	}
+	go m.offer()
+}
+
+// offer hands all certificates formed since the last proposal to the leader at once.
+func (m *Mempool) offer() {
+	var pending []string
+	for {
+		var ordered chan string
+		var digests string
+		if len(pending) > 0 {
+			ordered = m.ordered
+			digests = certPrefix + strings.Join(pending, ",")
+		}
+		select {
+		case digest := <-m.certified:
+			pending = append(pending, digest)
+		case ordered <- digests:
+			pending = nil
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Mempool) Stop() {
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+}
+
+// Submit hands a client command to the workers round robin.
+func (m *Mempool) Submit(cmd string) {
+	worker := int(m.next.Add(1)) % m.size
+	select {
+	case m.inputs[worker] <- cmd:
+	case <-m.done:
+	}
+}
+
+// Messages returns the number of batch and ack messages sent so far.
+func (m *Mempool) Messages() int64 {
+	return m.sent.Load()
+}
+
+func batchDigest(batch *Batch) string {
+	data, _ := json.Marshal(batch)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func (m *Mempool) runWorker(id int) {
+	seq := 0
+	var cmds []string
+	timer := time.NewTimer(m.conf.BatchTimeout)
+	seal := func() {
+		if len(cmds) > 0 {
+			select {
+			case m.inflight[id] <- struct{}{}:
+			case <-m.done:
+				return
+			}
+			go m.disseminate(&Batch{Worker: id, Seq: seq, Commands: cmds})
+			seq++
+			cmds = nil
+		}
+		timer.Reset(m.conf.BatchTimeout)
+	}
+	for {
+		select {
+		case cmd := <-m.inputs[id]:
+			cmds = append(cmds, cmd)
+			if len(cmds) >= m.conf.BatchSize {
+				seal()
+			}
+		case <-timer.C:
+			seal()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// disseminate broadcasts batch, collects the store acks and forwards the certificate for ordering.
+func (m *Mempool) disseminate(batch *Batch) {
+	defer func() { <-m.inflight[batch.Worker] }()
+	digest := batchDigest(batch)
+	acks := make(chan int, m.size)
+	for i := 0; i < m.size; i++ {
+		if i != batch.Worker {
+			m.sent.Add(2) // batch and ack
+		}
+		go func(i int) {
+			if i != batch.Worker {
+				time.Sleep(m.delay())
+			}
+			m.stores[i].put(digest, batch)
+			if i != batch.Worker {
+				time.Sleep(m.delay())
+			}
+			acks <- i
+		}(i)
+	}
+
+	cert := &Certificate{Digest: digest, Worker: batch.Worker}
+	for len(cert.Signers) < m.threshold {
+		select {
+		case i := <-acks:
+			cert.Signers = append(cert.Signers, i)
+		case <-m.done:
+			return
+		}
+	}
+	m.certsMu.Lock()
+	m.certs[digest] = cert
+	m.certsMu.Unlock()
+
+	select {
+	case m.certified <- digest:
+	case <-m.done:
+	}
+}
+
+func (s *batchStore) put(digest string, batch *Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[digest] = batch
+}
+
+func (s *batchStore) delete(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.batches, digest)
+}
+
+func (s *batchStore) get(digest string) (*Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch, ok := s.batches[digest]
+	return batch, ok
+}
+
+// Resolve returns the commands ordered by a committed block at node.
+// Blocks that don't carry certificates (e.g. placeholder commands) resolve to their command.
+func (m *Mempool) Resolve(node int, block *Block) ([]string, error) {
+	digests, ok := strings.CutPrefix(block.Command, certPrefix)
+	if !ok {
+		return []string{block.Command}, nil
+	}
+	var commands []string
+	for _, digest := range strings.Split(digests, ",") {
+		batch, err := m.fetch(node, digest)
+		if err != nil {
+			return commands, err
+		}
+		commands = append(commands, batch.Commands...)
+		m.gc(node, digest)
+	}
+	return commands, nil
+}
+
+// gc drops the batch once every node resolved it.
+func (m *Mempool) gc(node int, digest string) {
+	m.certsMu.Lock()
+	defer m.certsMu.Unlock()
+	if m.resolved[digest] == nil {
+		m.resolved[digest] = make(map[int]bool)
+	}
+	m.resolved[digest][node] = true
+	if len(m.resolved[digest]) < m.size {
+		return
+	}
+	for _, store := range m.stores {
+		store.delete(digest)
+	}
+	delete(m.certs, digest)
+	delete(m.resolved, digest)
+}
+
+func (m *Mempool) fetch(node int, digest string) (*Batch, error) {
+	if batch, ok := m.stores[node].get(digest); ok {
+		return batch, nil
+	}
+	// not received yet, fetch it from a signer of the certificate
+	m.certsMu.Lock()
+	cert := m.certs[digest]
+	m.certsMu.Unlock()
+	if cert == nil {
+		return nil, fmt.Errorf("unknown certificate %s", digest)
+	}
+	for _, signer := range cert.Signers {
+		if batch, ok := m.stores[signer].get(digest); ok {
+			m.sent.Add(2) // request and response
+			m.stores[node].put(digest, batch)
+			return batch, nil
+		}
+	}
+	return nil, fmt.Errorf("batch %s unavailable", digest)
+}
@@ -0,0 +1,62 @@
+package hotstuff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMempoolOrdersCertifiedBatches(t *testing.T) {
+	cluster := NewCluster(ClusterConfig{
+		Nodes:   NumNodes,
+		Leader:  0,
+		Delay:   DefaultDelay,
+		Mempool: &MempoolConfig{BatchSize: 10, BatchTimeout: 5 * time.Millisecond, MaxInflight: 2},
+	})
+	cluster.Start()
+	defer cluster.Stop()
+
+	const numCmds = 95 // the last batch is sealed by the timeout
+	for i := 0; i < numCmds; i++ {
+		cluster.Submit(fmt.Sprintf("tx-%d", i))
+	}
+
+	// node -> committed client commands in order
+	committed := make(map[int][]string)
+	heights := make(map[int]map[int]bool)
+	deadline := time.After(20 * Timeout)
+	for done := 0; done < NumNodes; {
+		select {
+		case c := <-cluster.Committed():
+			if heights[c.Node] == nil {
+				heights[c.Node] = make(map[int]bool)
+			}
+			if heights[c.Node][c.Block.Height] {
+				continue
+			}
+			heights[c.Node][c.Block.Height] = true
+			for _, cmd := range c.Commands {
+				if strings.HasPrefix(cmd, "tx-") {
+					assert.True(t, strings.HasPrefix(c.Block.Command, certPrefix), "commands must be ordered through certificates")
+					committed[c.Node] = append(committed[c.Node], cmd)
+				}
+			}
+			if len(committed[c.Node]) == numCmds {
+				done++
+			}
+		case <-deadline:
+			t.Fatalf("committed %d commands at node 0", len(committed[0]))
+		}
+	}
+	for i := 1; i < NumNodes; i++ {
+		assert.Equal(t, committed[0], committed[i])
+	}
+	seen := make(map[string]bool)
+	for _, cmd := range committed[0] {
+		assert.False(t, seen[cmd], "%s committed twice", cmd)
+		seen[cmd] = true
+	}
+}
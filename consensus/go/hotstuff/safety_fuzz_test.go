@@ -0,0 +1,243 @@
+package hotstuff
+
+import (
+	"fmt"
+	"testing"
+)
+
+/*
+## Safety fuzzing
+The fuzzer plays the leader and the network: the input bytes are decoded into a sequence of operations that
+propose blocks on top of any known block (so the proposals form a random block tree) justified by any QC formed so far,
+deliver phase messages to arbitrary replicas in arbitrary order, and fire timeouts.
+QCs are only formed from votes the replicas actually cast, so a leader can be Byzantine in what it proposes
+but can't forge a quorum. The leader doesn't equivocate within a view, the fuzzer collects the votes per view.
+invariant: no two replicas ever commit different blocks at the same height.
+*/
+
+const (
+	opPropose = iota
+	opPrepare
+	opPreCommit
+	opCommit
+	opDecide
+	opTimeout
+	numOps
+
+	// keeps heights below the capacity of decideCh, which commit fills while holding the node's lock
+	maxFuzzSteps = 64
+)
+
+type fuzzCluster struct {
+	t     *testing.T
+	nodes []*SimpleNode
+	sinks []*SimpleNode // stand in as allNodes, so the fuzzer receives every vote and newView
+
+	genesisQC *QC
+	proposals []*Block                       // proposal of view i+1
+	qcs       []*QC                          // every QC formed so far
+	votes     map[Phase]map[int]map[int]bool // phase -> view -> voters
+	committed map[int]string                 // height -> hash committed by any replica
+}
+
+func newFuzzCluster(t *testing.T) *fuzzCluster {
+	leaderConf := &BasicLeaderConf{LeaderID: 0, NextLeaderID: 0}
+	c := &fuzzCluster{
+		t:         t,
+		votes:     make(map[Phase]map[int]map[int]bool),
+		committed: make(map[int]string),
+	}
+	for i := 0; i < NumNodes; i++ {
+		node := NewSimpleNode(i, leaderConf)
+		node.delay = 0
+		c.nodes = append(c.nodes, node)
+		c.sinks = append(c.sinks, NewSimpleNode(i, leaderConf))
+	}
+	c.genesisQC = c.nodes[0].prepareQC
+	c.qcs = append(c.qcs, c.genesisQC)
+	return c
+}
+
+func (c *fuzzCluster) propose(parentIdx, qcIdx int) {
+	parent := c.nodes[0].blocks[0]
+	if len(c.proposals) > 0 && parentIdx%(len(c.proposals)+1) > 0 {
+		parent = c.proposals[parentIdx%(len(c.proposals)+1)-1]
+	}
+	justify := c.qcs[qcIdx%len(c.qcs)]
+	view := len(c.proposals) + 1
+	block := &Block{
+		Height:     parent.Height + 1,
+		Parent:     parent.Height,
+		ParentHash: parent.Hash,
+		Command:    fmt.Sprintf("fuzz-cmd-%d", view),
+		Proposer:   0,
+		View:       view,
+		Justify:    justify,
+	}
+	block.Hash = c.nodes[0].blockHash(block)
+	c.proposals = append(c.proposals, block)
+}
+
+// quorum forms the QC of phase for the proposal of view, if enough replicas voted for it.
+func (c *fuzzCluster) quorum(phase Phase, view int) *QC {
+	voters := c.votes[phase][view]
+	if len(voters) < QuorumSize {
+		return nil
+	}
+	block := c.proposals[view-1]
+	qc := &QC{Type: phase, View: view, Block: block.Height, BlockHash: block.Hash}
+	for i := range voters {
+		qc.Signers = append(qc.Signers, i)
+	}
+	return qc
+}
+
+// deliver hands msg to node and records the vote it casts, if any.
+func (c *fuzzCluster) deliver(node *SimpleNode, msg Message) {
+	var voted chan *Block
+	switch msg.Type {
+	case Prepare:
+		node.onPrepare(msg, c.sinks)
+		voted = node.prepareCh
+	case PreCommit:
+		node.onPreCommit(msg, c.sinks)
+		voted = node.preCommitCh
+	case Commit:
+		node.onCommit(msg, c.sinks)
+		voted = node.commitCh
+	case Decide:
+		node.onDecideQC(msg, c.sinks)
+	}
+	select {
+	case <-voted:
+		vote := <-c.sinks[node.leader(msg.View)].voteCh
+		if c.votes[vote.Type] == nil {
+			c.votes[vote.Type] = make(map[int]map[int]bool)
+		}
+		if c.votes[vote.Type][vote.View] == nil {
+			c.votes[vote.Type][vote.View] = make(map[int]bool)
+		}
+		c.votes[vote.Type][vote.View][vote.Sender] = true
+	default:
+	}
+}
+
+func (c *fuzzCluster) step(op, target, arg byte) {
+	node := c.nodes[int(target)%NumNodes]
+	switch int(op) % numOps {
+	case opPropose:
+		c.propose(int(target), int(arg))
+	case opPrepare:
+		if len(c.proposals) == 0 {
+			return
+		}
+		block := c.proposals[int(arg)%len(c.proposals)]
+		c.deliver(node, Message{Type: Prepare, View: block.View, Block: block, Justify: block.Justify, Sender: 0})
+	case opPreCommit, opCommit, opDecide:
+		if len(c.proposals) == 0 {
+			return
+		}
+		// the message of phase p carries the QC of phase p-1
+		phase := Phase(int(op) % numOps)
+		block := c.proposals[int(arg)%len(c.proposals)]
+		qc := c.quorum(phase-1, block.View)
+		if qc == nil {
+			return
+		}
+		c.qcs = append(c.qcs, qc)
+		c.deliver(node, Message{Type: phase, View: block.View, Block: block, Justify: qc, Sender: 0})
+	case opTimeout:
+		node.lastUpdate = node.lastUpdate.Add(-Timeout)
+		node.onTimeout(c.sinks)
+	}
+	c.drain()
+	c.check()
+}
+
+// drain discards the newView messages and commit notifications nobody waits for.
+func (c *fuzzCluster) drain() {
+	for len(c.sinks[0].msgCh) > 0 {
+		<-c.sinks[0].msgCh
+	}
+	for _, node := range c.nodes {
+		for len(node.decideCh) > 0 {
+			<-node.decideCh
+		}
+	}
+}
+
+func (c *fuzzCluster) check() {
+	for _, node := range c.nodes {
+		for h, block := range node.blocks {
+			if block == nil {
+				continue
+			}
+			if hash, ok := c.committed[h]; ok && hash != block.Hash {
+				c.t.Fatalf("conflicting blocks committed at height %d: %s (node %d) vs %s", h, block.Hash, node.ID, hash)
+			}
+			c.committed[h] = block.Hash
+		}
+	}
+}
+
+func FuzzSafetyRule(f *testing.F) {
+	// happy path: propose, then every phase to every replica
+	seed := []byte{opPropose, 0, 0}
+	for _, op := range []byte{opPrepare, opPreCommit, opCommit, opDecide} {
+		for i := byte(0); i < NumNodes; i++ {
+			seed = append(seed, op, i, 0)
+		}
+	}
+	f.Add(seed)
+	// fork: a second proposal on genesis while the first one is in flight
+	f.Add(append(append([]byte{}, seed[:3*9]...), opPropose, 0, 0, opPrepare, 1, 1, opPrepare, 2, 1, opPrepare, 3, 1, opTimeout, 1, 0))
+
+	// Byzantine leader: block 1 is decided by replica 0 only, then a conflicting block 1 is proposed on genesis
+	// to the replicas that missed Decide. They are locked on the precommitQC and must reject it.
+	conflict := []byte{opPropose, 0, 0}
+	for _, op := range []byte{opPrepare, opPreCommit, opCommit} {
+		for i := byte(0); i < QuorumSize; i++ {
+			conflict = append(conflict, op, i, 0)
+		}
+	}
+	conflict = append(conflict, opDecide, 0, 0, opPropose, 0, 0)
+	for _, op := range []byte{opPrepare, opPreCommit, opCommit, opDecide} {
+		for i := byte(1); i < NumNodes; i++ {
+			conflict = append(conflict, op, i, 1)
+		}
+	}
+	f.Add(conflict)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 3*maxFuzzSteps {
+			data = data[:3*maxFuzzSteps]
+		}
+		c := newFuzzCluster(t)
+		for i := 0; i+2 < len(data); i += 3 {
+			c.step(data[i], data[i+1], data[i+2])
+		}
+	})
+}
+
+// Competing blocks at the same height must not be mistaken for each other's ancestors.
+func TestExtendsFollowsHash(t *testing.T) {
+	node := NewSimpleNode(0, &BasicLeaderConf{LeaderID: 0, NextLeaderID: 0})
+	genesis := node.blocks[0]
+	a := node.createBlock(genesis, "a", node.prepareQC)
+	b := node.createBlock(genesis, "b", node.prepareQC)
+	c := node.createBlock(a, "c", nil)
+	for _, block := range []*Block{a, b, c} {
+		node.uncommitedBlocks[block.Hash] = block
+	}
+	qcA := &QC{Type: PreCommit, View: 1, Block: a.Height, BlockHash: a.Hash}
+	qcB := &QC{Type: PreCommit, View: 1, Block: b.Height, BlockHash: b.Hash}
+	if !node.extends(c, qcA) {
+		t.Fatal("c extends a")
+	}
+	if node.extends(c, qcB) {
+		t.Fatal("c doesn't extend its parent's sibling b")
+	}
+	if !node.extends(c, node.prepareQC) {
+		t.Fatal("c extends genesis")
+	}
+}
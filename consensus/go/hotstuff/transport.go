@@ -0,0 +1,157 @@
+package hotstuff
+
+/* TCP transport for running each node of a cluster in its own process.
+Handlers address peers as allNodes[id].msgCh / allNodes[id].voteCh, so remote peers are represented by stub nodes:
+whatever a local handler pushes into a stub's channels is encoded as newline-delimited JSON and written to that peer,
+and whatever a peer sends us is pushed into the local node's channels. The protocol code is unchanged.
+Messages to an unreachable peer are dropped, which the protocol treats as network loss and recovers by timeout.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type envelope struct {
+	Msg     *Message `json:"msg,omitempty"`
+	Vote    *Vote    `json:"vote,omitempty"`
+	Command string   `json:"command,omitempty"` // client command forwarded to the leader
+}
+
+type transport struct {
+	me    int
+	addrs []string
+	ln    net.Listener
+
+	peers []*peerConn
+
+	done chan struct{}
+}
+
+type peerConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+}
+
+// JoinCluster creates a cluster running only node id in this process, listening on addrs[id] and dialing the other addrs.
+func JoinCluster(conf ClusterConfig, id int, addrs []string) (*Cluster, error) {
+	if len(addrs) != conf.Nodes {
+		return nil, fmt.Errorf("expected %d addresses, got %d", conf.Nodes, len(addrs))
+	}
+	if id < 0 || id >= conf.Nodes {
+		return nil, fmt.Errorf("node id %d out of range [0, %d)", id, conf.Nodes)
+	}
+	if conf.Mempool != nil {
+		return nil, fmt.Errorf("the mempool only runs in-process")
+	}
+	ln, err := net.Listen("tcp", addrs[id])
+	if err != nil {
+		return nil, err
+	}
+	c := newCluster(conf, []int{id})
+	t := &transport{
+		me:    id,
+		addrs: addrs,
+		ln:    ln,
+		peers: make([]*peerConn, conf.Nodes),
+		done:  c.done,
+	}
+	for i := range t.peers {
+		t.peers[i] = &peerConn{}
+	}
+	c.transport = t
+
+	go t.accept(c)
+	for i, stub := range c.nodes {
+		if i != id {
+			go t.pump(i, stub)
+		}
+	}
+	return c, nil
+}
+
+// accept reads envelopes from peers and delivers them to the local node.
+func (t *transport) accept(c *Cluster) {
+	node := c.nodes[t.me]
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			dec := json.NewDecoder(bufio.NewReader(conn))
+			for {
+				var env envelope
+				if err := dec.Decode(&env); err != nil {
+					return
+				}
+				switch {
+				case env.Msg != nil:
+					node.msgCh <- *env.Msg
+				case env.Vote != nil:
+					node.voteCh <- *env.Vote
+				case env.Command != "":
+					c.Submit(env.Command)
+				}
+			}
+		}(conn)
+	}
+}
+
+// pump forwards whatever local handlers send to the stub of peer id.
+func (t *transport) pump(id int, stub *SimpleNode) {
+	for {
+		select {
+		case msg := <-stub.msgCh:
+			t.send(id, envelope{Msg: &msg})
+		case vote := <-stub.voteCh:
+			t.send(id, envelope{Vote: &vote})
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *transport) sendCommand(id int, cmd string) {
+	t.send(id, envelope{Command: cmd})
+}
+
+func (t *transport) send(id int, env envelope) {
+	p := t.peers[id]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", t.addrs[id], Timeout)
+		if err != nil {
+			debugf("[Node %d] drop message to unreachable peer %d: %v\n", t.me, id, err)
+			return
+		}
+		p.conn = conn
+		p.enc = json.NewEncoder(conn)
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	if err := p.enc.Encode(env); err != nil {
+		// reconnect on the next message
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (t *transport) close() {
+	t.ln.Close()
+	for _, p := range t.peers {
+		p.mu.Lock()
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}
+}
@@ -16,20 +16,24 @@ const (
 )
 
 type Block struct {
-	Height   int    `json:"height"`
-	View     int    `json:"view"`
-	Hash     string `json:"hash"`
-	Parent   int    `json:"parent"`
-	Command  string `json:"command"`
-	Proposer int    `json:"proposer"`
-	Justify  *QC    `json:"justify"`
+	Height int    `json:"height"`
+	View   int    `json:"view"`
+	Hash   string `json:"hash"`
+	Parent int    `json:"parent"`
+	// ParentHash identifies the parent among the blocks proposed at its height
+	ParentHash string `json:"parentHash"`
+	Command    string `json:"command"`
+	Proposer   int    `json:"proposer"`
+	Justify    *QC    `json:"justify"`
 }
 
 type QC struct {
-	Type    Phase `json:"type"`
-	View    int   `json:"view"`
-	Block   int   `json:"block"`
-	Signers []int `json:"signers"`
+	Type  Phase `json:"type"`
+	View  int   `json:"view"`
+	Block int   `json:"block"`
+	// BlockHash identifies the certified block among the blocks proposed at its height
+	BlockHash string `json:"blockHash"`
+	Signers   []int  `json:"signers"`
 }
 
 type Message struct {
@@ -41,10 +45,12 @@ type Message struct {
 }
 
 type Vote struct {
-	Type   Phase `json:"type"`
-	View   int   `json:"view"`
-	Block  int   `json:"block"`
-	Sender int   `json:"sender"`
+	Type  Phase `json:"type"`
+	View  int   `json:"view"`
+	Block int   `json:"block"`
+	// BlockHash is the hash of the block voted for
+	BlockHash string `json:"blockHash"`
+	Sender    int    `json:"sender"`
 }
 
 type HotStuff struct {
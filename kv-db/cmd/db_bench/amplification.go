@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ioCounters are the storage counters of /proc/self/io. The kernel charges a write to the process
+// when it dirties the page cache, so writes are counted even if writeback happens after the run.
+type ioCounters struct {
+	read, written, cancelled uint64
+}
+
+// readProcIO returns the counters of /proc/self/io, zero where they aren't available.
+func readProcIO() ioCounters {
+	var c ioCounters
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return c
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value, _ := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		switch k {
+		case "read_bytes":
+			c.read = value
+		case "write_bytes":
+			c.written = value
+		case "cancelled_write_bytes":
+			// dirty pages of files that were truncated or deleted before they were written back
+			c.cancelled = value
+		}
+	}
+	return c
+}
+
+// dirSize returns the bytes allocated by the files under dir.
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			size += uint64(st.Blocks) * 512
+		} else {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// amplification compares what the benchmark asked the dbs to do with what reached the disk.
+type amplification struct {
+	UserBytesWritten uint64 `json:"user_bytes_written"` // keys and values that were Put
+	DiskBytesWritten uint64 `json:"disk_bytes_written"` // including what Close wrote
+	DiskBytesRead    uint64 `json:"disk_bytes_read"`
+	Gets             int64  `json:"gets"`
+	DiskUsage        uint64 `json:"disk_usage"`   // of the db directories after Close
+	LogicalSize      uint64 `json:"logical_size"` // -keys keys of the average key and value size
+
+	WriteAmp        float64 `json:"write_amp"`
+	SpaceAmp        float64 `json:"space_amp"`
+	ReadBytesPerGet float64 `json:"read_bytes_per_get"`
+}
+
+// measureAmplification computes the amplification of a run from the /proc/self/io difference and the dbs' directories.
+func measureAmplification(stats []*threadStats, io ioCounters, dirs []string) amplification {
+	a := amplification{
+		DiskBytesWritten: io.written - min(io.cancelled, io.written),
+		DiskBytesRead:    io.read,
+	}
+	for _, st := range stats {
+		a.UserBytesWritten += st.userWritten
+		a.Gets += st.gets
+	}
+	for _, dir := range dirs {
+		size, err := dirSize(dir)
+		if err != nil {
+			fmt.Printf("measuring the size of %s failed: %v\n", dir, err)
+		}
+		a.DiskUsage += size
+	}
+	// every key is 32 bytes, values are sized uniformly in [s, S)
+	avgRecord := 32 + float64(*valueSizeSmall+*valueSizeBig-1)/2
+	a.LogicalSize = uint64(float64(*dbSize) * avgRecord)
+	if a.UserBytesWritten > 0 {
+		a.WriteAmp = float64(a.DiskBytesWritten) / float64(a.UserBytesWritten)
+	}
+	if a.LogicalSize > 0 {
+		a.SpaceAmp = float64(a.DiskUsage) / float64(a.LogicalSize)
+	}
+	if a.Gets > 0 {
+		a.ReadBytesPerGet = float64(a.DiskBytesRead) / float64(a.Gets)
+	}
+	return a
+}
+
+func (a amplification) String() string {
+	const mib = 1024 * 1024
+	s := fmt.Sprintf("disk written %.1fMiB, read %.1fMiB, usage %.1fMiB", float64(a.DiskBytesWritten)/mib, float64(a.DiskBytesRead)/mib, float64(a.DiskUsage)/mib)
+	if a.UserBytesWritten > 0 {
+		s += fmt.Sprintf("\nwrite amplification %.2f (%.1fMiB of keys and values put)", a.WriteAmp, float64(a.UserBytesWritten)/mib)
+	}
+	s += fmt.Sprintf("\nspace amplification %.2f (%d keys of -keys, %.1fMiB)", a.SpaceAmp, *dbSize, float64(a.LogicalSize)/mib)
+	if a.Gets > 0 {
+		s += fmt.Sprintf("\nread bytes per get %.1f", a.ReadBytesPerGet)
+	}
+	return s
+}
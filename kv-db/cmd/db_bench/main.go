@@ -7,13 +7,18 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"kv_db/lsm_db"
 	pebble_v2 "kv_db/pebble_api"
+	"kv_db/sharded_db"
 	"kv_db/simple_db"
 	"log"
+	"math"
+	"math/bits"
 	"math/rand"
 	"os"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
@@ -26,26 +31,86 @@ var N = flag.Int64("N", 0, "size of the keys")
 var dbSize = flag.Int64("keys", 10000000, "number of keys in db")
 
 var startKeyFlag = flag.Int64("start", 0, "start key")
-var op = flag.String("op", "randwrite", "operation: write, randwrite, read, randread")
-var r = flag.Int64("r", 100000, "report interval")
+var op = flag.String("op", "randwrite", "operation: write, randwrite, read, randread, seekscan, prefixscan, mixed, ycsb-a ... ycsb-f")
+var r = flag.Duration("r", time.Second, "interval of the throughput reports, 0 disables them")
 var valueSizeSmall = flag.Int("s", 50, "value size small")
 var valueSizeBig = flag.Int("S", 51, "value size big (inclusive)")
 var t = flag.Int("t", 8, "threads")
 var v = flag.Int("v", 3, "verbosity")
 var handles = flag.Int("handles", 0, "max open files")
-var cache = flag.Int("cache", 512, "cache size")
+var cache = flag.Int("cache", 512, "cache size in MiB: the block cache and memtables of pebble and pebblev2, simple's value cache (0 disables it)")
 var dbn = flag.Int("dbn", 1, "number of dbs")
-var dbFlag = flag.String("db", "pebble", "db type: pebble, simple, pebblev2")
+var sharded = flag.Bool("sharded", false, "route keys to the -dbn dbs through a sharded_db.ShardedStore, by consistent hashing of the key bytes, instead of key % dbn, dbs written with it have to be read with it")
+var dbFlag = flag.String("db", "pebble", "db type: pebble, simple, pebblev2, lsm")
+var hashedKeys = flag.Bool("hashedkeys", false, "simple: index the keys in a hash table presized for -keys instead of a B-tree, a fraction of the memory but no iterators, so no seekscan, prefixscan or ycsb-e")
 var valueFlag = flag.String("V", "fnv", "value generator: fnv, simple")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var pooledHash = flag.Bool("pooledHash", false, "use hash pool")
+var batchSize = flag.Int("batch", 0, "write keys in batches of this many puts, 0 writes them one by one")
+var syncFlag = flag.String("sync", "none", "durability: none, interval (group commit every -syncinterval), always (fsync every write)")
+var syncInterval = flag.Duration("syncinterval", 10*time.Millisecond, "sync interval of -sync interval")
+var metricsInterval = flag.Duration("metrics", 0, "log pebblev2 stats at this interval, 0 disables it")
+var blockSize = flag.Int("blocksize", pebble_v2.DefaultOptions.BlockSize, "pebblev2 L0 block size, doubling with every level")
+var bloomBits = flag.Int("bloombits", pebble_v2.DefaultOptions.BloomBitsPerKey, "pebblev2 and lsm bloom filter bits per key, 0 disables them")
+var readRatio = flag.Float64("readratio", 0.5, "fraction of reads in -op mixed, the rest are updates")
+var scanLength = flag.Int("scanlen", 100, "number of keys -op seekscan reads after a seek, ycsb-e reads a uniformly random number up to it")
+var distFlag = flag.String("dist", "", "key distribution: uniform, zipfian, hotspot, latest; by default write/read are sequential, randwrite/randread shuffled and ycsb-* use YCSB's")
+var theta = flag.Float64("theta", 0.99, "skew of -dist zipfian and latest, the higher the more skewed")
+var hotSet = flag.Float64("hotset", 0.2, "fraction of the keys that are hot with -dist hotspot")
+var hotOps = flag.Float64("hotops", 0.8, "fraction of the operations that go to the hot keys with -dist hotspot")
+var l0Threshold = flag.Int("l0threshold", pebble_v2.DefaultOptions.L0CompactionThreshold, "pebblev2 L0 compaction threshold")
 
 type KeyValueStore interface {
 	ethdb.KeyValueReader
 	ethdb.KeyValueWriter
+	ethdb.KeyValueSyncer
+	ethdb.Batcher
+	ethdb.Iteratee
 	io.Closer
 }
 
+func durability() simple_db.Durability {
+	switch *syncFlag {
+	case "none":
+		return simple_db.SyncNone
+	case "interval":
+		return simple_db.SyncInterval
+	case "always":
+		return simple_db.SyncAlways
+	}
+	log.Fatalf("unknown sync mode %q", *syncFlag)
+	return simple_db.SyncNone
+}
+
+// shardsOf returns the dbs behind the ShardedStore of -sharded, or dbs.
+func shardsOf(dbs []KeyValueStore) []KeyValueStore {
+	store, ok := dbs[0].(*sharded_db.ShardedStore)
+	if !ok {
+		return dbs
+	}
+	shards := make([]KeyValueStore, len(store.Shards()))
+	for i, shard := range store.Shards() {
+		shards[i] = shard
+	}
+	return shards
+}
+
+// syncPeriodically group commits the pebble WAL, simple_db does it by itself with SyncInterval.
+func syncPeriodically(db KeyValueStore, done chan struct{}) {
+	ticker := time.NewTicker(*syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.SyncKeyValue(); err != nil {
+				log.Printf("sync failed: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
 func generateRandomData(size int, seed uint64) []byte {
 	// a simple FNV 64 bytes algorithm
 	if size == 0 {
@@ -61,8 +126,177 @@ func generateRandomData(size int, seed uint64) []byte {
 	return data[:size]
 }
 
+// hashKey returns the key of the i-th key of the db.
+func hashKey(i int64) []byte {
+	buf := [8]byte{}
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	if *pooledHash {
+		return crypto.Keccak256Hash(buf[:]).Bytes()
+	}
+	hfunc := sha256.New()
+	hfunc.Write(buf[:])
+	return hfunc.Sum(nil)
+}
+
+func valueSizeOf(i int64) int {
+	return int(i%int64(*valueSizeBig-*valueSizeSmall) + int64(*valueSizeSmall))
+}
+
+// makeValue returns the value of the i-th key.
+func makeValue(i int64) []byte {
+	valueSize := valueSizeOf(i)
+	var value []byte
+	if *valueFlag == "fnv" {
+		value = generateRandomData(valueSize, uint64(i))
+	} else if *valueFlag == "simple" {
+		value = make([]byte, valueSize)
+		for j := 0; j < len(value); j++ {
+			value[j] = byte(int(i) + j)
+		}
+	} else {
+		panic("unknown value generator")
+	}
+	return value
+}
+
+// keyDist picks keys in [0, keys), the number of keys may grow between calls. It is not safe for concurrent use.
+type keyDist interface {
+	next(rnd *rand.Rand, keys int64) int64
+}
+
+type uniformDist struct{}
+
+func (uniformDist) next(rnd *rand.Rand, keys int64) int64 {
+	return rnd.Int63n(keys)
+}
+
+// hotspotDist sends hotOps of the picks to the first hotSet of the keys, both uniformly.
+type hotspotDist struct {
+	hotSet, hotOps float64
+}
+
+func (d hotspotDist) next(rnd *rand.Rand, keys int64) int64 {
+	hot := max(int64(float64(keys)*d.hotSet), 1)
+	if rnd.Float64() < d.hotOps || hot == keys {
+		return rnd.Int63n(hot)
+	}
+	return hot + rnd.Int63n(keys-hot)
+}
+
+// zipfianDist picks key i with probability proportional to 1/(i+1)^theta, key 0 is the hottest.
+// It is the algorithm of Gray et al., "Quickly Generating Billion-Record Synthetic Databases", as used by YCSB.
+type zipfianDist struct {
+	theta, alpha, zeta2 float64
+	keys                int64
+	zetaN, eta          float64
+}
+
+func newZipfianDist(keys int64, theta float64) *zipfianDist {
+	z := &zipfianDist{theta: theta, alpha: 1 / (1 - theta), zeta2: zeta(1, 2, theta)}
+	z.resize(keys)
+	return z
+}
+
+// zeta returns the sum of 1/i^theta for i in [from, to]. Beyond a million terms it approximates the rest
+// by the integral, which keeps setting up billions of keys fast and is off by far less than the sampling noise.
+func zeta(from, to int64, theta float64) float64 {
+	const exact = 1000000
+	sum := 0.0
+	i := from
+	for ; i <= to && i < from+exact; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	if i <= to {
+		sum += (math.Pow(float64(to)+0.5, 1-theta) - math.Pow(float64(i)-0.5, 1-theta)) / (1 - theta)
+	}
+	return sum
+}
+
+func (z *zipfianDist) resize(keys int64) {
+	if keys > z.keys {
+		z.zetaN += zeta(z.keys+1, keys, z.theta)
+	} else {
+		z.zetaN = zeta(1, keys, z.theta)
+	}
+	z.keys = keys
+	z.eta = (1 - math.Pow(2/float64(keys), 1-z.theta)) / (1 - z.zeta2/z.zetaN)
+}
+
+func (z *zipfianDist) next(rnd *rand.Rand, keys int64) int64 {
+	if keys != z.keys {
+		z.resize(keys)
+	}
+	u := rnd.Float64()
+	uz := u * z.zetaN
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return min(1, keys-1)
+	}
+	return min(int64(float64(keys)*math.Pow(z.eta*u-z.eta+1, z.alpha)), keys-1)
+}
+
+// latestDist is zipfian over the keys from the last one back, so recently inserted keys are the hottest.
+type latestDist struct {
+	z *zipfianDist
+}
+
+func (d latestDist) next(rnd *rand.Rand, keys int64) int64 {
+	return keys - 1 - d.z.next(rnd, keys)
+}
+
+// newKeyDist returns a constructor of name's distribution over keys keys, call it once per goroutine.
+// The zipfian setup is shared, so it is only computed once.
+func newKeyDist(name string, keys int64) func() keyDist {
+	switch name {
+	case "uniform":
+		return func() keyDist { return uniformDist{} }
+	case "hotspot":
+		if *hotSet <= 0 || *hotSet > 1 || *hotOps < 0 || *hotOps > 1 {
+			log.Fatalf("-hotset must be in (0, 1] and -hotops in [0, 1]")
+		}
+		return func() keyDist { return hotspotDist{hotSet: *hotSet, hotOps: *hotOps} }
+	case "zipfian", "latest":
+		if *theta <= 0 || *theta >= 1 {
+			log.Fatalf("-theta must be in (0, 1)")
+		}
+		base := newZipfianDist(keys, *theta)
+		return func() keyDist {
+			z := *base
+			if name == "latest" {
+				return latestDist{&z}
+			}
+			return &z
+		}
+	}
+	log.Fatalf("unknown key distribution %q", name)
+	return nil
+}
+
+// describeDist returns name and its skew parameters, so results show what they were measured with.
+func describeDist(name string) string {
+	switch name {
+	case "zipfian", "latest":
+		return fmt.Sprintf("%s theta=%g", name, *theta)
+	case "hotspot":
+		return fmt.Sprintf("%s hotset=%g hotops=%g", name, *hotSet, *hotOps)
+	}
+	return name
+}
+
 func generateKeys() []int64 {
 	keys := make([]int64, *N)
+	if *distFlag != "" {
+		fmt.Printf("generating keys, distribution %s...\n", describeDist(*distFlag))
+		dist := newKeyDist(*distFlag, *N)()
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := range keys {
+			keys[i] = dist.next(rnd, *N) + *startKeyFlag
+		}
+		return keys
+	}
+	fmt.Println("generating keys...")
 	for i := int64(0); i < *N; i++ {
 		keys[i] = i + *startKeyFlag
 	}
@@ -73,7 +307,256 @@ func generateKeys() []int64 {
 	return keys
 }
 
+// workload is the mix of operations of a mixed run, the proportions add up to 1.
+type workload struct {
+	read, update, rmw, insert, scan float64
+	// distribution of the keys that reads, updates and scans pick, -dist overrides it
+	dist string
+}
+
+// YCSB core workloads, see https://github.com/brianfrankcooper/YCSB/wiki/Core-Workloads
+var workloads = map[string]workload{
+	"ycsb-a": {read: 0.5, update: 0.5, dist: "zipfian"},   // update heavy
+	"ycsb-b": {read: 0.95, update: 0.05, dist: "zipfian"}, // read mostly
+	"ycsb-c": {read: 1, dist: "zipfian"},                  // read only
+	"ycsb-d": {read: 0.95, insert: 0.05, dist: "latest"},  // read latest
+	"ycsb-e": {scan: 0.95, insert: 0.05, dist: "zipfian"}, // short ranges
+	"ycsb-f": {read: 0.5, rmw: 0.5, dist: "zipfian"},      // read-modify-write
+}
+
+const (
+	opRead = iota
+	opUpdate
+	opRMW
+	opInsert
+	opScan
+	opWrite
+	opBatchWrite
+	opSeek
+	opPrefixScan
+	numOps
+)
+
+var opNames = [numOps]string{"read", "update", "rmw", "insert", "scan", "write", "batch write", "seek", "prefix scan"}
+
+func (w workload) pick(rnd *rand.Rand) int {
+	x := rnd.Float64()
+	for op, p := range [...]float64{w.read, w.update, w.rmw, w.insert, w.scan} {
+		if x < p {
+			return op
+		}
+		x -= p
+	}
+	return opRead
+}
+
+// runMixed runs *n operations of w over the *N keys from *startKeyFlag on, inserts add keys behind them.
+func runMixed(dbs []KeyValueStore, w workload, stats []*threadStats) {
+	// keys below loaded are readable, inserts take ids from next and publish them in loaded once written
+	var loaded, next atomic.Int64
+	loaded.Store(*N)
+	next.Store(*N)
+	tsize := *n / int64(*t)
+
+	newDist := newKeyDist(w.dist, *N)
+	var misses atomic.Int64
+	var wg sync.WaitGroup
+	for ti := 0; ti < *t; ti++ {
+		ops := tsize
+		if ti == *t-1 {
+			ops = *n - int64(ti)*tsize
+		}
+		wg.Add(1)
+		go func(ti int, ops int64, st *threadStats) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(ti)))
+			dist := newDist()
+			choose := func() int64 {
+				return *startKeyFlag + dist.next(rnd, loaded.Load())
+			}
+			write := func(k int64) {
+				key, value := hashKey(k), makeValue(k)
+				if err := dbs[k%int64(len(dbs))].Put(key, value); err != nil {
+					panic(err)
+				}
+				st.userWritten += uint64(len(key) + len(value))
+			}
+			for i := int64(0); i < ops; i++ {
+				op := w.pick(rnd)
+				begin := time.Now()
+				switch op {
+				case opRead, opRMW:
+					k := choose()
+					value, err := dbs[k%int64(len(dbs))].Get(hashKey(k))
+					st.gets++
+					if err != nil {
+						// an insert that is not published yet, or a key that wasn't loaded
+						misses.Add(1)
+					} else if len(value) != valueSizeOf(k) {
+						panic("data verification failed")
+					}
+					// read-modify-write writes back the key it read
+					if op == opRMW {
+						write(k)
+					}
+				case opUpdate:
+					write(choose())
+				case opInsert:
+					write(*startKeyFlag + next.Add(1) - 1)
+					loaded.Add(1)
+				case opScan:
+					k := choose()
+					// keys are hashes, so a scan starting at a key reads a random run of keys
+					scan(dbs[k%int64(len(dbs))].NewIterator(nil, hashKey(k)), rnd.Intn(*scanLength)+1, st)
+				}
+				st.record(op, time.Since(begin))
+				st.ops.Add(1)
+			}
+		}(ti, ops, stats[ti])
+	}
+	wg.Wait()
+
+	if m := misses.Load(); m > 0 {
+		fmt.Printf("%d reads missed their key\n", m)
+	}
+}
+
+// A histogram counts latencies in log-linear buckets like an HDR histogram: every power of two
+// is split into 1<<subBucketBits buckets, so a bucket is off by less than 1% from what it counts.
+const (
+	subBucketBits = 7
+	histBuckets   = (64 - subBucketBits) << subBucketBits
+)
+
+type histogram struct {
+	counts [histBuckets]uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(v uint64) int {
+	if v < 1<<subBucketBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return (shift+1)<<subBucketBits + int(v>>shift) - 1<<subBucketBits
+}
+
+// bucketMax returns the largest value that falls into bucket i.
+func bucketMax(i int) uint64 {
+	if i < 1<<subBucketBits {
+		return uint64(i)
+	}
+	shift := i>>subBucketBits - 1
+	sub := uint64(i&(1<<subBucketBits-1) + 1<<subBucketBits)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[bucketOf(uint64(max(d, 0)))]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.count += o.count
+	h.sum += o.sum
+	h.max = max(h.max, o.max)
+}
+
+// quantile returns the latency that q of the recorded ones are at or below.
+func (h *histogram) quantile(q float64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	seen := uint64(0)
+	for i, c := range h.counts {
+		if seen += c; seen >= rank && c > 0 {
+			return min(time.Duration(bucketMax(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) String() string {
+	return fmt.Sprintf("count %d, mean %v, p50 %v, p90 %v, p99 %v, p999 %v, max %v",
+		h.count, h.sum/time.Duration(h.count), h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.quantile(0.999), h.max)
+}
+
+// threadStats are the latencies, the number of keys done and the bytes put of one benchmark thread,
+// ops is read by the throughput reports meanwhile.
+type threadStats struct {
+	hists       [numOps]*histogram
+	ops         atomic.Int64
+	userWritten uint64 // bytes of the keys and values Put
+	gets        int64
+
+	scannedKeys, scannedBytes int64
+}
+
+func (st *threadStats) record(op int, d time.Duration) {
+	if st.hists[op] == nil {
+		st.hists[op] = new(histogram)
+	}
+	st.hists[op].record(d)
+}
+
+func newThreadStats(threads int) []*threadStats {
+	stats := make([]*threadStats, threads)
+	for i := range stats {
+		stats[i] = new(threadStats)
+	}
+	return stats
+}
+
+// reportThroughput prints the throughput of every interval of *r until done is closed.
+func reportThroughput(stats []*threadStats, done chan struct{}) {
+	if *r == 0 {
+		return
+	}
+	ticker := time.NewTicker(*r)
+	defer ticker.Stop()
+	start := time.Now()
+	last, lastTime := int64(0), start
+	for {
+		select {
+		case now := <-ticker.C:
+			total := int64(0)
+			for _, st := range stats {
+				total += st.ops.Load()
+			}
+			fmt.Printf("%6.1fs: %.0f ops/s, %d ops\n", now.Sub(start).Seconds(), float64(total-last)/now.Sub(lastTime).Seconds(), total)
+			last, lastTime = total, now
+		case <-done:
+			return
+		}
+	}
+}
+
+// mergeLatencies merges the histograms of all threads per operation, operations that didn't run are nil.
+func mergeLatencies(stats []*threadStats) [numOps]*histogram {
+	var hists [numOps]*histogram
+	for op := range hists {
+		for _, st := range stats {
+			if st.hists[op] == nil {
+				continue
+			}
+			if hists[op] == nil {
+				hists[op] = new(histogram)
+			}
+			hists[op].merge(st.hists[op])
+		}
+	}
+	return hists
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(compareMain(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *cpuprofile != "" {
@@ -90,17 +573,47 @@ func main() {
 		endfix = "pooled"
 	}
 
+	mode := durability()
+	syncDone := make(chan struct{})
 	dbs := make([]KeyValueStore, *dbn)
+	dirs := make([]string, *dbn)
 	for i := 0; i < *dbn; i++ {
 		var db KeyValueStore
 		var err error
+		dirs[i] = fmt.Sprintf("bench_%s_%d_%s_%d", *dbFlag, *dbSize, endfix, i)
 		// cache = 512 is borrowed from https://github.com/QuarkChain/op-geth/blob/aa013db3d548c34e87063c72bed6777ada0fa2ae/eth/ethconfig/config.go#L57
 		if *dbFlag == "pebble" {
-			db, err = pebble.New(fmt.Sprintf("bench_pebble_%d_%s_%d", *dbSize, endfix, i), *cache, *handles, "", false)
+			if mode == simple_db.SyncAlways {
+				log.Fatal("go-ethereum's pebble always writes with NoSync, use -db pebblev2 for -sync always")
+			}
+			db, err = pebble.New(dirs[i], *cache, *handles, "", false)
 		} else if *dbFlag == "simple" {
-			db, err = simple_db.NewDatabase(fmt.Sprintf("bench_simple_%d_%s_%d", *dbSize, endfix, i))
+			opts := simple_db.DefaultOptions
+			opts.Durability = mode
+			opts.SyncInterval = *syncInterval
+			opts.CacheSize = int64(*cache) * 1024 * 1024
+			if *hashedKeys {
+				opts.HashedKeys = true
+				opts.ExpectedKeys = *dbSize / int64(*dbn)
+			}
+			db, err = simple_db.NewDatabaseWithOptions(dirs[i], opts)
 		} else if *dbFlag == "pebblev2" {
-			db, err = pebble_v2.New(fmt.Sprintf("bench_pebblev2__%d_%s_%d", *dbSize, endfix, i), *cache, *handles)
+			opts := pebble_v2.DefaultOptions
+			opts.Cache = *cache
+			opts.Handles = *handles
+			opts.Sync = mode == simple_db.SyncAlways
+			opts.BlockSize = *blockSize
+			opts.BloomBitsPerKey = *bloomBits
+			opts.L0CompactionThreshold = *l0Threshold
+			opts.MetricsInterval = *metricsInterval
+			// the name has a second underscore since pebblev2 was added, keep it so existing dbs are found
+			dirs[i] = fmt.Sprintf("bench_pebblev2__%d_%s_%d", *dbSize, endfix, i)
+			db, err = pebble_v2.NewWithOptions(dirs[i], opts)
+		} else if *dbFlag == "lsm" {
+			opts := lsm_db.DefaultOptions
+			opts.Sync = mode == simple_db.SyncAlways
+			opts.BloomBitsPerKey = *bloomBits
+			db, err = lsm_db.NewDatabaseWithOptions(dirs[i], opts)
 		} else {
 			panic("Unknow db")
 		}
@@ -109,10 +622,27 @@ func main() {
 			panic(err)
 		}
 		dbs[i] = db
-		defer db.Close()
+		if mode == simple_db.SyncInterval && *dbFlag != "simple" {
+			go syncPeriodically(db, syncDone)
+		}
+	}
+	if *sharded {
+		shards := make([]sharded_db.KeyValueStore, len(dbs))
+		for i, db := range dbs {
+			shards[i] = db
+		}
+		store, err := sharded_db.New(shards)
+		if err != nil {
+			panic(err)
+		}
+		// the benchmark sees a single db that does the routing
+		dbs = []KeyValueStore{store}
 	}
 
 	var startTime time.Time
+	ioBefore := readProcIO()
+	stats := newThreadStats(*t)
+	reportDone := make(chan struct{})
 
 	if *N == 0 {
 		*N = *n
@@ -123,11 +653,11 @@ func main() {
 	if *op == "write" || *op == "randwrite" {
 		tsize := *n / int64(*t)
 
-		fmt.Println("generating keys...")
 		keys := generateKeys()
 
 		fmt.Println("start writing data...")
 		startTime = time.Now()
+		go reportThroughput(stats, reportDone)
 		var wg sync.WaitGroup
 		for ti := 0; ti < *t; ti++ {
 			endKey := int64(ti+1) * tsize
@@ -136,72 +666,70 @@ func main() {
 			}
 
 			wg.Add(1)
-			go func(ti int, keys []int64) {
+			go func(ti int, keys []int64, st *threadStats) {
 				defer wg.Done()
+				// one pending batch per db
+				batches := make([]ethdb.Batch, len(dbs))
+				batched := make([]int, len(dbs))
+				for i := range batches {
+					batches[i] = dbs[i].NewBatch()
+				}
 				for i := 0; i < len(keys); i++ {
-					buf := [8]byte{}
-					binary.BigEndian.PutUint64(buf[:], uint64(keys[i]))
-					var key []byte
-					if *pooledHash {
-						key = crypto.Keccak256Hash(buf[:]).Bytes()
+					key := hashKey(keys[i])
+					value := makeValue(keys[i])
 
-					} else {
-						hfunc := sha256.New()
-						hfunc.Write(buf[:])
-						key = hfunc.Sum(nil)
-					}
-
-					valueSize := keys[i]%int64(*valueSizeBig-*valueSizeSmall) + int64(*valueSizeSmall)
-
-					var value []byte
-					if *valueFlag == "fnv" {
-						value = generateRandomData(int(valueSize), uint64(keys[i]))
-					} else if *valueFlag == "simple" {
-						value = make([]byte, valueSize)
-						for j := 0; j < len(value); j++ {
-							value[j] = byte(int(keys[i]) + j)
+					dbi := keys[i] % int64(len(dbs))
+					if *batchSize > 0 {
+						batches[dbi].Put(key, value)
+						if batched[dbi]++; batched[dbi] == *batchSize {
+							begin := time.Now()
+							if err := batches[dbi].Write(); err != nil {
+								panic(err)
+							}
+							st.record(opBatchWrite, time.Since(begin))
+							batches[dbi].Reset()
+							batched[dbi] = 0
 						}
 					} else {
-						panic("unknown value generator")
+						begin := time.Now()
+						if err := dbs[dbi].Put(key, value); err != nil {
+							panic(err)
+						}
+						st.record(opWrite, time.Since(begin))
 					}
-
-					dbs[keys[i]%int64(*dbn)].Put(key, value)
+					st.userWritten += uint64(len(key) + len(value))
+					st.ops.Add(1)
 					if *v == 4 {
 						fmt.Printf("thread: %d, write %d\n", ti, keys[i])
 					} else if *v == 5 {
 						fmt.Printf("thread: %d, write %s:%s\n", ti, hex.EncodeToString(key), hex.EncodeToString(value))
 					}
-					if *r != 0 && int64(i)%*r == 0 {
-						fmt.Printf("thread: %d, task: %d\n", ti, i)
+				}
+				for i, b := range batches {
+					if batched[i] > 0 {
+						begin := time.Now()
+						if err := b.Write(); err != nil {
+							panic(err)
+						}
+						st.record(opBatchWrite, time.Since(begin))
 					}
 				}
-			}(ti, keys[int64(ti)*tsize:endKey])
+			}(ti, keys[int64(ti)*tsize:endKey], stats[ti])
 		}
 		wg.Wait()
 	} else if *op == "read" || *op == "randread" {
 		tsize := *n / int64(*t)
 
-		fmt.Println("generating keys...")
 		keys := generateKeys()
 		hashKeys := make([][]byte, len(keys))
 		// precalculate hash
 		for i, key := range keys {
-			buf := [8]byte{}
-			binary.BigEndian.PutUint64(buf[:], uint64(key))
-			var hash []byte
-			if *pooledHash {
-				hash = crypto.Keccak256Hash(buf[:]).Bytes()
-
-			} else {
-				hfunc := sha256.New()
-				hfunc.Write(buf[:])
-				hash = hfunc.Sum(nil)
-			}
-			hashKeys[i] = hash
+			hashKeys[i] = hashKey(key)
 		}
 
 		fmt.Println("start reading data...")
 		startTime = time.Now()
+		go reportThroughput(stats, reportDone)
 		var wg sync.WaitGroup
 		for ti := 0; ti < *t; ti++ {
 			endKey := int64(ti+1) * tsize
@@ -210,33 +738,98 @@ func main() {
 			}
 
 			wg.Add(1)
-			go func(ti int, keys []int64) {
+			go func(ti int, keys []int64, st *threadStats) {
 				defer wg.Done()
 				for i := 0; i < len(keys); i++ {
 					key := hashKeys[int64(ti)*tsize+int64(i)]
 
-					valueSize := keys[i]%int64(*valueSizeBig-*valueSizeSmall) + int64(*valueSizeSmall)
-
-					value, err := dbs[keys[i]%int64(*dbn)].Get(key)
-					if err != nil || len(value) != int(valueSize) {
+					begin := time.Now()
+					value, err := dbs[keys[i]%int64(len(dbs))].Get(key)
+					st.record(opRead, time.Since(begin))
+					st.gets++
+					if err != nil || len(value) != valueSizeOf(keys[i]) {
 						panic("data verification failed")
 					}
+					st.ops.Add(1)
 					if *v == 4 {
 						fmt.Printf("thread: %d, read %d\n", ti, keys[i])
 					} else if *v == 5 {
 						fmt.Printf("thread: %d, read %s:%s\n", ti, hex.EncodeToString(key), hex.EncodeToString(value))
 					}
-					if *r != 0 && int64(i)%*r == 0 {
-						fmt.Printf("thread: %d, task: %d\n", ti, i)
-					}
 				}
-			}(ti, keys[int64(ti)*tsize:endKey])
+			}(ti, keys[int64(ti)*tsize:endKey], stats[ti])
 		}
 		wg.Wait()
+	} else if *op == "seekscan" || *op == "prefixscan" {
+		dist := *distFlag
+		if dist == "" {
+			dist = "uniform"
+		}
+		fmt.Printf("start %s, key distribution %s...\n", *op, describeDist(dist))
+		startTime = time.Now()
+		go reportThroughput(stats, reportDone)
+		runScans(dbs, dist, *op == "prefixscan", stats)
+	} else if w, ok := workloads[*op]; ok || *op == "mixed" {
+		if *op == "mixed" {
+			w = workload{read: *readRatio, update: 1 - *readRatio, dist: "uniform"}
+		}
+		if *distFlag != "" {
+			w.dist = *distFlag
+		}
+		fmt.Printf("start %s workload, key distribution %s...\n", *op, describeDist(w.dist))
+		startTime = time.Now()
+		go reportThroughput(stats, reportDone)
+		runMixed(dbs, w, stats)
 	} else {
 		panic("Unknown operation")
 	}
 
 	elapsed := time.Since(startTime)
+	close(reportDone)
 	fmt.Printf("used time %f, ops %f\n", elapsed.Seconds(), float64(*n)/elapsed.Seconds())
+	hists := mergeLatencies(stats)
+	for op, h := range hists {
+		if h != nil {
+			fmt.Printf("%s: %v\n", opNames[op], h)
+		}
+	}
+	scans := mergeScans(stats, elapsed)
+	if scans.Keys > 0 {
+		fmt.Println(scans)
+	}
+	for i, db := range shardsOf(dbs) {
+		switch db := db.(type) {
+		case *pebble_v2.PebbleV2:
+			fmt.Printf("db %d: %v\n", i, db.Stats())
+		case *simple_db.Database:
+			fmt.Printf("db %d: %v\n", i, db.IndexStats())
+			if *cache > 0 {
+				fmt.Printf("db %d: %v\n", i, db.CacheStats())
+			}
+		case *lsm_db.Database:
+			stat, _ := db.Stat()
+			fmt.Printf("db %d: %s\n", i, stat)
+		}
+	}
+
+	// what the dbs write on Close is part of the run
+	close(syncDone)
+	for i, db := range dbs {
+		if err := db.Close(); err != nil {
+			log.Printf("closing db %d failed: %v", i, err)
+		}
+	}
+	ioAfter := readProcIO()
+	amp := measureAmplification(stats, ioCounters{
+		read:      ioAfter.read - ioBefore.read,
+		written:   ioAfter.written - ioBefore.written,
+		cancelled: ioAfter.cancelled - ioBefore.cancelled,
+	}, dirs)
+	fmt.Println(amp)
+
+	if *outFile != "" {
+		if err := writeResult(*outFile, *outFormat, newResult(elapsed, hists, amp, scans)); err != nil {
+			log.Printf("writing the result to %s failed: %v", *outFile, err)
+		}
+	}
 }
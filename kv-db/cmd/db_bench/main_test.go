@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const samples = 200000
+
+// frequencies draws samples keys from d and returns how often each was picked.
+func frequencies(t *testing.T, d keyDist, keys int64) []float64 {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	freq := make([]float64, keys)
+	for i := 0; i < samples; i++ {
+		k := d.next(rnd, keys)
+		if k < 0 || k >= keys {
+			t.Fatalf("key %d out of [0, %d)", k, keys)
+		}
+		freq[k] += 1.0 / samples
+	}
+	return freq
+}
+
+func within(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*want
+}
+
+func TestZipfianSkew(t *testing.T) {
+	const keys, theta = 1000, 0.99
+	freq := frequencies(t, newZipfianDist(keys, theta), keys)
+	zetaN := zeta(1, keys, theta)
+	// the two hottest keys are exact, the tail is approximated
+	for i := 0; i < 2; i++ {
+		want := 1 / math.Pow(float64(i+1), theta) / zetaN
+		if !within(freq[i], want, 0.05) {
+			t.Errorf("key %d picked %.4f of the time, want %.4f", i, freq[i], want)
+		}
+	}
+	hot := 0.0
+	for _, f := range freq[:keys/10] {
+		hot += f
+	}
+	if want := zeta(1, keys/10, theta) / zetaN; !within(hot, want, 0.05) {
+		t.Errorf("the first tenth of the keys got %.3f of the picks, want %.3f", hot, want)
+	}
+
+	// growing the key space keeps the skew over all keys
+	z := newZipfianDist(keys, theta)
+	z.next(rand.New(rand.NewSource(1)), 10*keys)
+	if want := newZipfianDist(10*keys, theta); !within(z.zetaN, want.zetaN, 1e-9) || !within(z.eta, want.eta, 1e-9) {
+		t.Errorf("resized zeta %g eta %g, want %g %g", z.zetaN, z.eta, want.zetaN, want.eta)
+	}
+}
+
+func TestLatestSkew(t *testing.T) {
+	const keys, theta = 1000, 0.99
+	z := newZipfianDist(keys, theta)
+	freq := frequencies(t, latestDist{z}, keys)
+	// the last key is the hottest
+	if want := 1 / zeta(1, keys, theta); !within(freq[keys-1], want, 0.05) {
+		t.Errorf("last key picked %.4f of the time, want %.4f", freq[keys-1], want)
+	}
+	if freq[keys-1] <= freq[keys-2] || freq[keys-2] <= freq[0] {
+		t.Errorf("newest keys aren't the hottest: %.4f %.4f, oldest %.4f", freq[keys-1], freq[keys-2], freq[0])
+	}
+}
+
+func TestHotspotSkew(t *testing.T) {
+	const keys = 1000
+	freq := frequencies(t, hotspotDist{hotSet: 0.2, hotOps: 0.8}, keys)
+	hot, hotMin, hotMax := 0.0, 1.0, 0.0
+	for _, f := range freq[:keys/5] {
+		hot += f
+		hotMin, hotMax = min(hotMin, f), max(hotMax, f)
+	}
+	if !within(hot, 0.8, 0.01) {
+		t.Errorf("the hot set got %.3f of the picks, want 0.8", hot)
+	}
+	// uniform within the hot set, every hot key is about 0.8/200 = 0.004
+	if hotMin < 0.003 || hotMax > 0.005 {
+		t.Errorf("hot keys picked between %.4f and %.4f of the time, want about 0.004", hotMin, hotMax)
+	}
+	// a hot set of all keys is uniform
+	freq = frequencies(t, hotspotDist{hotSet: 1, hotOps: 0}, 10)
+	for k, f := range freq {
+		if !within(f, 0.1, 0.05) {
+			t.Errorf("key %d picked %.3f of the time, want 0.1", k, f)
+		}
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	// latencies of 1ms to 1000ms in 1ms steps, split over two histograms
+	var h, other histogram
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i) * time.Millisecond
+		if i%2 == 0 {
+			h.record(d)
+		} else {
+			other.record(d)
+		}
+	}
+	h.merge(&other)
+	if h.count != 1000 || h.max != time.Second || h.sum != 500500*time.Millisecond {
+		t.Fatalf("count %d, max %v, sum %v", h.count, h.max, h.sum)
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.001, time.Millisecond},
+		{0.5, 500 * time.Millisecond},
+		{0.9, 900 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{0.999, 999 * time.Millisecond},
+	} {
+		// a bucket reports its largest value, which is less than 1% above what it counts
+		got := h.quantile(tc.q)
+		if got < tc.want || float64(got) > float64(tc.want)*1.01 {
+			t.Errorf("p%g is %v, want %v", tc.q*100, got, tc.want)
+		}
+	}
+	if got := h.quantile(1); got != time.Second {
+		t.Errorf("p100 is %v, want the max", got)
+	}
+
+	// values below 1<<subBucketBits have a bucket each
+	var small histogram
+	for i := 1; i <= 100; i++ {
+		small.record(time.Duration(i))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if got, want := small.quantile(q), time.Duration(math.Round(q*100)); got != want {
+			t.Errorf("p%g is %v, want %v", q*100, got, want)
+		}
+	}
+}
+
+func TestBucketOf(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 1 << 20, 1<<40 + 12345, math.MaxInt64} {
+		i := bucketOf(v)
+		if v > bucketMax(i) || (i > 0 && v <= bucketMax(i-1)) {
+			t.Errorf("%d is in bucket %d, which holds (%d, %d]", v, i, bucketMax(i-1), bucketMax(i))
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var outFile = flag.String("out", "", "append the result record of the run to this file")
+var outFormat = flag.String("format", "json", "format of -out: json (one record per line, what compare reads) or csv (one row per operation)")
+
+// result is the machine-readable record of a run.
+type result struct {
+	Time      time.Time          `json:"time"`
+	DB        string             `json:"db"`
+	Op        string             `json:"op"`
+	Flags     map[string]string  `json:"flags"`
+	Host      hostInfo           `json:"host"`
+	Ops       int64              `json:"ops"`
+	Seconds   float64            `json:"seconds"`
+	OpsPerSec float64            `json:"ops_per_sec"`
+	Latencies map[string]latency `json:"latencies"`
+	Scan      *scanStats         `json:"scan,omitempty"`
+	amplification
+}
+
+// latency summarizes a histogram, the durations are in microseconds.
+type latency struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_us"`
+	P50   float64 `json:"p50_us"`
+	P90   float64 `json:"p90_us"`
+	P99   float64 `json:"p99_us"`
+	P999  float64 `json:"p999_us"`
+	Max   float64 `json:"max_us"`
+}
+
+type hostInfo struct {
+	Hostname  string `json:"hostname"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	CPUs      int    `json:"cpus"`
+	CPUModel  string `json:"cpu_model,omitempty"`
+	MemTotal  uint64 `json:"mem_total,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func summarize(h *histogram) latency {
+	return latency{
+		Count: h.count,
+		Mean:  micros(h.sum / time.Duration(h.count)),
+		P50:   micros(h.quantile(0.5)),
+		P90:   micros(h.quantile(0.9)),
+		P99:   micros(h.quantile(0.99)),
+		P999:  micros(h.quantile(0.999)),
+		Max:   micros(h.max),
+	}
+}
+
+func newResult(elapsed time.Duration, hists [numOps]*histogram, amp amplification, scans scanStats) *result {
+	res := &result{
+		Time:          time.Now().UTC(),
+		DB:            *dbFlag,
+		Op:            *op,
+		Flags:         make(map[string]string),
+		Host:          readHostInfo(),
+		Ops:           *n,
+		Seconds:       elapsed.Seconds(),
+		OpsPerSec:     float64(*n) / elapsed.Seconds(),
+		Latencies:     make(map[string]latency),
+		amplification: amp,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		res.Flags[f.Name] = f.Value.String()
+	})
+	for op, h := range hists {
+		if h != nil {
+			res.Latencies[opNames[op]] = summarize(h)
+		}
+	}
+	if scans.Keys > 0 {
+		res.Scan = &scans
+	}
+	return res
+}
+
+func readHostInfo() hostInfo {
+	host := hostInfo{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		CPUs:      runtime.NumCPU(),
+		GoVersion: runtime.Version(),
+	}
+	host.Hostname, _ = os.Hostname()
+	if f, err := os.Open("/proc/cpuinfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if k, v, ok := strings.Cut(scanner.Text(), ":"); ok && strings.TrimSpace(k) == "model name" {
+				host.CPUModel = strings.TrimSpace(v)
+				break
+			}
+		}
+		f.Close()
+	}
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		var kb uint64
+		if _, err := fmt.Fscanf(f, "MemTotal: %d kB", &kb); err == nil {
+			host.MemTotal = kb * 1024
+		}
+		f.Close()
+	}
+	return host
+}
+
+var csvHeader = []string{"time", "db", "op", "latency_op", "count", "mean_us", "p50_us", "p90_us", "p99_us", "p999_us", "max_us",
+	"ops", "seconds", "ops_per_sec", "user_bytes_written", "disk_bytes_written", "disk_bytes_read", "disk_usage",
+	"write_amp", "space_amp", "read_bytes_per_get", "threads", "hostname", "flags"}
+
+// writeResult appends res to path in format.
+func writeResult(path, format string, res *result) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(data, '\n'))
+		return err
+	case "csv":
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		if stat.Size() == 0 {
+			w.Write(csvHeader)
+		}
+		var flags []string
+		for k, v := range res.Flags {
+			flags = append(flags, k+"="+v)
+		}
+		sort.Strings(flags)
+		for _, name := range opNames {
+			l, ok := res.Latencies[name]
+			if !ok {
+				continue
+			}
+			w.Write([]string{
+				res.Time.Format(time.RFC3339), res.DB, res.Op, name, strconv.FormatUint(l.Count, 10),
+				fmtFloat(l.Mean), fmtFloat(l.P50), fmtFloat(l.P90), fmtFloat(l.P99), fmtFloat(l.P999), fmtFloat(l.Max),
+				strconv.FormatInt(res.Ops, 10), fmtFloat(res.Seconds), fmtFloat(res.OpsPerSec),
+				strconv.FormatUint(res.UserBytesWritten, 10), strconv.FormatUint(res.DiskBytesWritten, 10),
+				strconv.FormatUint(res.DiskBytesRead, 10), strconv.FormatUint(res.DiskUsage, 10),
+				fmtFloat(res.WriteAmp), fmtFloat(res.SpaceAmp), fmtFloat(res.ReadBytesPerGet),
+				res.Flags["t"], res.Host.Hostname, strings.Join(flags, " "),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown result format %q", format)
+}
+
+func fmtFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+// readResults reads the JSON records of a result file.
+func readResults(path string) ([]*result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var results []*result
+	dec := json.NewDecoder(f)
+	for {
+		res := new(result)
+		if err := dec.Decode(res); errors.Is(err, io.EOF) {
+			return results, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		results = append(results, res)
+	}
+}
+
+// compareMain implements "db_bench compare [-threshold t] old new": it matches the runs of the two result files by
+// db and op (the last run of each wins) and flags throughput drops and latency increases beyond the threshold.
+// It returns the exit status, 1 if there is a regression.
+func compareMain(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.05, "relative change that counts as a regression")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: db_bench compare [-threshold t] old.json new.json")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	olds, err := readResults(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	news, err := readResults(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	byRun := func(results []*result) map[string]*result {
+		m := make(map[string]*result)
+		for _, res := range results {
+			m[res.DB+" "+res.Op] = res
+		}
+		return m
+	}
+	oldRuns, newRuns := byRun(olds), byRun(news)
+
+	regressions := 0
+	// higherIsBetter tells whether a decrease or an increase is the regression
+	row := func(name string, old, new float64, higherIsBetter bool) {
+		change := 0.0
+		if old != 0 {
+			change = (new - old) / old
+		}
+		mark := ""
+		if (higherIsBetter && change < -*threshold) || (!higherIsBetter && change > *threshold) {
+			mark = "  REGRESSION"
+			regressions++
+		}
+		fmt.Printf("  %-22s %14.2f %14.2f %+8.1f%%%s\n", name, old, new, change*100, mark)
+	}
+	matched := 0
+	for _, cur := range news {
+		key := cur.DB + " " + cur.Op
+		old, ok := oldRuns[key]
+		if !ok || newRuns[key] != cur {
+			continue
+		}
+		matched++
+		fmt.Printf("%s %s: %s -> %s\n", cur.DB, cur.Op, old.Time.Format(time.RFC3339), cur.Time.Format(time.RFC3339))
+		row("ops/s", old.OpsPerSec, cur.OpsPerSec, true)
+		if old.Scan != nil && cur.Scan != nil {
+			row("scanned keys/s", old.Scan.KeysPerSec, cur.Scan.KeysPerSec, true)
+			row("scanned MiB/s", old.Scan.BytesPerSec/1024/1024, cur.Scan.BytesPerSec/1024/1024, true)
+		}
+		if old.WriteAmp > 0 && cur.WriteAmp > 0 {
+			row("write amplification", old.WriteAmp, cur.WriteAmp, false)
+		}
+		if old.SpaceAmp > 0 && cur.SpaceAmp > 0 {
+			row("space amplification", old.SpaceAmp, cur.SpaceAmp, false)
+		}
+		for _, name := range opNames {
+			o, ok1 := old.Latencies[name]
+			c, ok2 := cur.Latencies[name]
+			if !ok1 || !ok2 {
+				continue
+			}
+			row(name+" p50 us", o.P50, c.P50, false)
+			row(name+" p99 us", o.P99, c.P99, false)
+			row(name+" p999 us", o.P999, c.P999, false)
+		}
+	}
+	if matched == 0 {
+		fmt.Fprintln(os.Stderr, "no runs with the same db and op in both files")
+		return 2
+	}
+	if regressions > 0 {
+		fmt.Printf("%d regressions beyond %.1f%%\n", regressions, *threshold*100)
+		return 1
+	}
+	return 0
+}
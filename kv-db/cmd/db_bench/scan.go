@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var prefixLength = flag.Int("prefixlen", 2, "key prefix length of -op prefixscan, every scan reads the 1/256^prefixlen of the keys under a random prefix")
+
+// scanStats are the keys and bytes read by iterators.
+type scanStats struct {
+	Keys        int64   `json:"keys"`
+	Bytes       int64   `json:"bytes"`
+	KeysPerSec  float64 `json:"keys_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+func (s scanStats) String() string {
+	return fmt.Sprintf("scanned %d keys, %.0f keys/s, %.1fMiB, %.1fMiB/s", s.Keys, s.KeysPerSec, float64(s.Bytes)/1024/1024, s.BytesPerSec/1024/1024)
+}
+
+func mergeScans(stats []*threadStats, elapsed time.Duration) scanStats {
+	var s scanStats
+	for _, st := range stats {
+		s.Keys += st.scannedKeys
+		s.Bytes += st.scannedBytes
+	}
+	s.KeysPerSec = float64(s.Keys) / elapsed.Seconds()
+	s.BytesPerSec = float64(s.Bytes) / elapsed.Seconds()
+	return s
+}
+
+// scan reads up to limit keys of it, all of them if limit is negative, and releases it.
+// The time until the first key is recorded as a seek.
+func scan(it ethdb.Iterator, limit int, st *threadStats) {
+	defer it.Release()
+	begin := time.Now()
+	for i := 0; i != limit && it.Next(); i++ {
+		if i == 0 {
+			st.record(opSeek, time.Since(begin))
+		}
+		st.scannedKeys++
+		st.scannedBytes += int64(len(it.Key()) + len(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// runScans runs *n seeks to a random key followed by *scanLength Next calls, or with prefix
+// *n scans of all keys under the first *prefixLength bytes of a random key.
+func runScans(dbs []KeyValueStore, dist string, prefix bool, stats []*threadStats) {
+	newDist := newKeyDist(dist, *N)
+	tsize := *n / int64(*t)
+	var wg sync.WaitGroup
+	for ti := 0; ti < *t; ti++ {
+		ops := tsize
+		if ti == *t-1 {
+			ops = *n - int64(ti)*tsize
+		}
+		wg.Add(1)
+		go func(ti int, ops int64, st *threadStats) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(ti)))
+			dist := newDist()
+			for i := int64(0); i < ops; i++ {
+				k := *startKeyFlag + dist.next(rnd, *N)
+				key := hashKey(k)
+				begin := time.Now()
+				if prefix {
+					scan(dbs[k%int64(len(dbs))].NewIterator(key[:min(*prefixLength, len(key))], nil), -1, st)
+					st.record(opPrefixScan, time.Since(begin))
+				} else {
+					scan(dbs[k%int64(len(dbs))].NewIterator(nil, key), *scanLength, st)
+					st.record(opScan, time.Since(begin))
+				}
+				st.ops.Add(1)
+			}
+		}(ti, ops, stats[ti])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,178 @@
+package lsm_db
+
+/* A batch is logged as one record, so it is replayed all or nothing.
+DeleteRange is resolved to deletes of the keys in the range when the batch is written.
+*/
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// pendingOp is a write waiting in a batch, or a DeleteRange [key, rangeEnd) if isRange is set, a nil rangeEnd is unbounded.
+type pendingOp struct {
+	batchOp
+	rangeEnd []byte
+	isRange  bool
+}
+
+// batch is a write-only batch that commits changes to its host database
+// when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	db   *Database
+	ops  []pendingOp
+	size int
+}
+
+// NewBatch creates a write-only key-value store that buffers changes to its host
+// database until a final write is called.
+func (db *Database) NewBatch() ethdb.Batch {
+	return &batch{db: db}
+}
+
+// NewBatchWithSize creates a write-only database batch with pre-allocated buffer.
+func (db *Database) NewBatchWithSize(size int) ethdb.Batch {
+	return &batch{db: db, ops: make([]pendingOp, 0, size/64)}
+}
+
+// DeleteRange deletes all keys in [start, end), a nil end deletes everything from start on.
+func (db *Database) DeleteRange(start, end []byte) error {
+	b := db.NewBatch()
+	if err := b.DeleteRange(start, end); err != nil {
+		return err
+	}
+	return b.Write()
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.ops = append(b.ops, pendingOp{batchOp: batchOp{kind: kindSet, key: bytes.Clone(key), value: bytes.Clone(value)}})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.ops = append(b.ops, pendingOp{batchOp: batchOp{kind: kindDelete, key: bytes.Clone(key)}})
+	b.size += len(key)
+	return nil
+}
+
+// DeleteRange removes all keys in the range [start, end) from the batch for
+// later committing, inclusive on start, exclusive on end.
+func (b *batch) DeleteRange(start, end []byte) error {
+	b.ops = append(b.ops, pendingOp{batchOp: batchOp{kind: kindDelete, key: bytes.Clone(start)}, rangeEnd: bytes.Clone(end), isRange: true})
+	b.size += len(start) + len(end)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to disk. The keys of a DeleteRange are the ones
+// an iterator sees at the time of Write, together with the writes of the batch before it.
+func (b *batch) Write() error {
+	return b.db.writeBatch(b.ops)
+}
+
+// writeBatch resolves the range deletions of pending and writes the batch under the same lock,
+// so no write can slip into a range between resolving it and the batch.
+func (db *Database) writeBatch(pending []pendingOp) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.makeRoomForWrite(); err != nil {
+		return err
+	}
+	ops := make([]batchOp, 0, len(pending))
+	for i, op := range pending {
+		if !op.isRange {
+			ops = append(ops, op.batchOp)
+			continue
+		}
+		keys, err := db.keysInRange(op.key, op.rangeEnd, pending[:i])
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			ops = append(ops, batchOp{kind: kindDelete, key: key})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return db.commit(ops)
+}
+
+// keysInRange returns the keys in [start, end) after the batch ops before the range deletion, db.lock must be held.
+func (db *Database) keysInRange(start, end []byte, before []pendingOp) ([][]byte, error) {
+	live := make(map[string]bool)
+	it := db.newIterator(nil, start)
+	for it.Next() {
+		if end != nil && bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+		live[string(it.Key())] = true
+	}
+	it.release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	for _, op := range before {
+		switch {
+		case op.isRange:
+			for key := range live {
+				if inRange([]byte(key), op.key, op.rangeEnd) {
+					delete(live, key)
+				}
+			}
+		case inRange(op.key, start, end):
+			live[string(op.key)] = op.kind == kindSet
+		}
+	}
+	var keys [][]byte
+	for key, ok := range live {
+		if ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys, nil
+}
+
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.ops = b.ops[:0]
+	b.size = 0
+}
+
+// Replay replays the batch contents.
+func (b *batch) Replay(w ethdb.KeyValueWriter) error {
+	for _, op := range b.ops {
+		switch {
+		case op.isRange:
+			rangeDeleter, ok := w.(ethdb.KeyValueRangeDeleter)
+			if !ok {
+				return errors.New("ethdb.KeyValueWriter does not implement DeleteRange")
+			}
+			if err := rangeDeleter.DeleteRange(op.key, op.rangeEnd); err != nil {
+				return err
+			}
+		case op.kind == kindDelete:
+			if err := w.Delete(op.key); err != nil {
+				return err
+			}
+		default:
+			if err := w.Put(op.key, op.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
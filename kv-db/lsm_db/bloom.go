@@ -0,0 +1,53 @@
+package lsm_db
+
+// bloom is a bloom filter over the keys of a table like LevelDB's: the bit array followed by the number of probes,
+// the probes are derived from one 32-bit hash by double hashing.
+type bloom []byte
+
+func bloomHash(key []byte) uint32 {
+	// FNV-1a, the filters are persisted so the hash must not be seeded
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+func newBloom(hashes []uint32, bitsPerKey int) bloom {
+	// k = ln(2) * bits per key minimizes the false positive rate
+	k := max(1, min(30, bitsPerKey*69/100))
+	bits := max(64, len(hashes)*bitsPerKey)
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+	f := make(bloom, bytes+1)
+	f[bytes] = byte(k)
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			pos := h % uint32(bits)
+			f[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return f
+}
+
+// mayContain returns false if key is definitely not in the filter, an empty filter contains everything.
+func (f bloom) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
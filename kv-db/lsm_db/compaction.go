@@ -0,0 +1,626 @@
+package lsm_db
+
+/* The tables form a version: L0 newest first, L1 and below sorted by key. Flushes and compactions install a new
+version, readers reference the version they started with so its tables stay open until they are done. A table
+that is no longer part of the current version is deleted once the last version holding it is released.
+
+The background goroutine compacts the level with the highest score once it reaches 1: L0 scores its number of tables
+over L0CompactionTrigger, the other levels their size over their maximum size. All of L0 is merged with the overlapping
+L1 tables, a level below picks its tables round-robin by key and merges one with the overlapping tables of the next
+level. A table that overlaps nothing in the next level is moved down without rewriting it, except by Compact.
+Tombstones are dropped once no level below the output has keys in their range.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestName = "MANIFEST"
+	tmpSuffix    = ".tmp"
+)
+
+type version struct {
+	levels [numLevels][]*table
+	refs   int // the database while it is current, Gets and iterators reading it
+}
+
+// newVersion references the tables of levels, db.lock must be held.
+func newVersion(levels [numLevels][]*table) *version {
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.refs++
+		}
+	}
+	return &version{levels: levels, refs: 1}
+}
+
+// unref releases v, closing the tables nothing references anymore and deleting the obsolete ones. db.lock must be held.
+func (v *version) unref(db *Database) {
+	if v == nil {
+		return
+	}
+	if v.refs--; v.refs > 0 {
+		return
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if t.refs--; t.refs > 0 {
+				continue
+			}
+			t.f.Close()
+			if t.obsolete {
+				if err := os.Remove(tablePath(db.path, t.num)); err != nil {
+					log.Printf("lsm_db: deleting table %d failed: %v", t.num, err)
+				}
+			}
+		}
+	}
+}
+
+// get looks key up in the tables, newest first.
+func (v *version) get(db *Database, key []byte) (value []byte, deleted, found bool, err error) {
+	for _, t := range v.levels[0] {
+		if !t.overlaps(key, key) {
+			continue
+		}
+		if value, deleted, found, err = t.get(db, key); found || err != nil {
+			return
+		}
+	}
+	for _, tables := range v.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool {
+			return bytes.Compare(tables[i].largest, key) >= 0
+		})
+		if i == len(tables) || bytes.Compare(tables[i].smallest, key) > 0 {
+			continue
+		}
+		if value, deleted, found, err = tables[i].get(db, key); found || err != nil {
+			return
+		}
+	}
+	return nil, false, false, nil
+}
+
+func totalSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// keyRange returns the smallest and the largest key of tables.
+func keyRange(tables []*table) (smallest, largest []byte) {
+	for _, t := range tables {
+		if smallest == nil || bytes.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if largest == nil || bytes.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
+
+// overlapping returns the tables of a level below L0 that have keys in [start, end], a nil end is unbounded.
+func overlapping(tables []*table, start, end []byte) []*table {
+	var res []*table
+	for _, t := range tables {
+		if bytes.Compare(t.largest, start) >= 0 && (end == nil || bytes.Compare(t.smallest, end) <= 0) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// maxLevelSize is the size at which a level below L0 is compacted.
+func (db *Database) maxLevelSize(level int) int64 {
+	size := db.opts.LevelSize
+	for i := 1; i < level; i++ {
+		size *= int64(db.opts.LevelMultiplier)
+	}
+	return size
+}
+
+type compaction struct {
+	level          int
+	inputs         [2][]*table // of level and level+1
+	dropTombstones bool
+	rewrite        bool // no trivial move, Compact rewrites its inputs to drop tombstones and overwritten values
+}
+
+// pickCompaction returns the compaction of the level with the highest score, nil if no level needs one.
+// db.lock must be held.
+func (db *Database) pickCompaction() *compaction {
+	v := db.current
+	best, bestScore := -1, 1.0
+	for level := 0; level < numLevels-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(v.levels[0])) / float64(db.opts.L0CompactionTrigger)
+		} else {
+			score = float64(totalSize(v.levels[level])) / float64(db.maxLevelSize(level))
+		}
+		if score >= bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	c := &compaction{level: best}
+	if best == 0 {
+		c.inputs[0] = slices.Clone(v.levels[0])
+	} else {
+		tables := v.levels[best]
+		i := slices.IndexFunc(tables, func(t *table) bool {
+			return bytes.Compare(t.smallest, db.compactPointer[best]) > 0
+		})
+		if i < 0 {
+			i = 0
+		}
+		c.inputs[0] = []*table{tables[i]}
+		db.compactPointer[best] = tables[i].largest
+	}
+	db.expand(c)
+	return c
+}
+
+// rangeCompaction returns the compaction of the tables of level with keys in [start, limit], nil if there are none.
+// All of L0 is compacted as an older L0 table left behind could shadow the newer values moved to L1. db.lock must be held.
+func (db *Database) rangeCompaction(level int, start, limit []byte) *compaction {
+	v := db.current
+	c := &compaction{level: level}
+	if level == 0 {
+		for _, t := range v.levels[0] {
+			if bytes.Compare(t.largest, start) >= 0 && (limit == nil || bytes.Compare(t.smallest, limit) <= 0) {
+				c.inputs[0] = slices.Clone(v.levels[0])
+				break
+			}
+		}
+	} else {
+		c.inputs[0] = overlapping(v.levels[level], start, limit)
+	}
+	if len(c.inputs[0]) == 0 {
+		return nil
+	}
+	db.expand(c)
+	return c
+}
+
+// expand adds the tables of the next level that overlap the inputs and decides whether tombstones can be dropped.
+func (db *Database) expand(c *compaction) {
+	v := db.current
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = overlapping(v.levels[c.level+1], smallest, largest)
+	smallest, largest = keyRange(append(slices.Clone(c.inputs[0]), c.inputs[1]...))
+	c.dropTombstones = true
+	for _, tables := range v.levels[c.level+2:] {
+		if len(overlapping(tables, smallest, largest)) > 0 {
+			c.dropTombstones = false
+		}
+	}
+}
+
+// flush writes the immutable memtable to an L0 table and deletes its log. db.compactMu must be held.
+func (db *Database) flush() error {
+	db.lock.Lock()
+	imm := db.imm
+	db.lock.Unlock()
+
+	it := newMemIterator(imm.entries, nil)
+	tables, err := db.writeTables(it, false, false)
+	it.Close()
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	levels := db.current.levels
+	levels[0] = append(slices.Clone(tables), levels[0]...)
+	if err := db.installVersion(levels, db.mem.logNum, nil); err != nil {
+		deleteTables(db.path, tables)
+		return err
+	}
+	db.imm = nil
+	db.stats.Flushes++
+	db.stats.BytesFlushed += totalSize(tables)
+	db.cond.Broadcast()
+	if err := os.Remove(logPath(db.path, imm.logNum)); err != nil {
+		log.Printf("lsm_db: deleting log %d failed: %v", imm.logNum, err)
+	}
+	return nil
+}
+
+// runCompaction merges the inputs of c into the next level. db.compactMu must be held.
+func (db *Database) runCompaction(c *compaction) error {
+	var outputs []*table
+	trivial := len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && !c.rewrite
+	if trivial {
+		// trivial move
+		outputs = c.inputs[0]
+	} else {
+		// newer first: the L0 tables are newest first, the inputs of the next level don't overlap each other
+		var iters []internalIterator
+		for _, tables := range c.inputs {
+			for _, t := range tables {
+				iters = append(iters, newTableIterator(db, t, nil))
+			}
+		}
+		it := newMergingIterator(iters)
+		var err error
+		outputs, err = db.writeTables(it, c.dropTombstones, true)
+		it.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	levels := db.current.levels
+	inputs := append(slices.Clone(c.inputs[0]), c.inputs[1]...)
+	for _, level := range []int{c.level, c.level + 1} {
+		levels[level] = slices.DeleteFunc(slices.Clone(levels[level]), func(t *table) bool {
+			return slices.Contains(inputs, t)
+		})
+	}
+	levels[c.level+1] = append(levels[c.level+1], outputs...)
+	slices.SortFunc(levels[c.level+1], func(a, b *table) int {
+		return bytes.Compare(a.smallest, b.smallest)
+	})
+	if trivial {
+		if err := db.installVersion(levels, db.logNum, nil); err != nil {
+			return err
+		}
+		db.stats.TrivialMoves++
+	} else {
+		if err := db.installVersion(levels, db.logNum, inputs); err != nil {
+			deleteTables(db.path, outputs)
+			return err
+		}
+		db.stats.BytesCompacted += totalSize(outputs)
+	}
+	db.stats.Compactions++
+	db.cond.Broadcast()
+	return nil
+}
+
+// writeTables writes the entries of it to new tables, starting a new one at TableSize if split is set.
+func (db *Database) writeTables(it internalIterator, dropTombstones, split bool) ([]*table, error) {
+	var tables []*table
+	var tw *tableWriter
+	var num uint64
+	fail := func(err error) ([]*table, error) {
+		if tw != nil {
+			tw.abandon()
+		}
+		deleteTables(db.path, tables)
+		return nil, err
+	}
+	for it.Next() {
+		if it.Deleted() && dropTombstones {
+			continue
+		}
+		if tw == nil {
+			num = db.newFileNum()
+			var err error
+			if tw, err = newTableWriter(db.path, num, &db.opts); err != nil {
+				return fail(err)
+			}
+		}
+		if err := tw.add(it.Key(), it.Value(), it.Deleted()); err != nil {
+			return fail(err)
+		}
+		if split && tw.size() >= db.opts.TableSize {
+			t, err := tw.finish(num)
+			tw = nil
+			if err != nil {
+				return fail(err)
+			}
+			tables = append(tables, t)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return fail(err)
+	}
+	if tw != nil {
+		t, err := tw.finish(num)
+		tw = nil
+		if err != nil {
+			return fail(err)
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+func (db *Database) newFileNum() uint64 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	num := db.nextNum
+	db.nextNum++
+	return num
+}
+
+// deleteTables closes and deletes tables that never made it into a version.
+func deleteTables(dir string, tables []*table) {
+	for _, t := range tables {
+		t.f.Close()
+		os.Remove(tablePath(dir, t.num))
+	}
+}
+
+// installVersion writes the MANIFEST of levels and makes them the current version, obsolete are the tables
+// it drops for good. db.lock must be held.
+func (db *Database) installVersion(levels [numLevels][]*table, logNum uint64, obsolete []*table) error {
+	if err := writeManifest(db.path, db.nextNum, logNum, levels); err != nil {
+		return err
+	}
+	for _, t := range obsolete {
+		t.obsolete = true
+	}
+	old := db.current
+	db.current = newVersion(levels)
+	db.logNum = logNum
+	old.unref(db)
+	return nil
+}
+
+// Compact flushes the memtable and compacts the tables with keys in [start, limit] down to the last level
+// that has tables, at least into L1, a nil limit is unbounded.
+func (db *Database) Compact(start []byte, limit []byte) error {
+	db.lock.Lock()
+	for {
+		if db.closed {
+			db.lock.Unlock()
+			return errClosed
+		}
+		if db.bgErr != nil {
+			db.lock.Unlock()
+			return db.bgErr
+		}
+		if db.imm == nil {
+			if db.mem.empty() {
+				break
+			}
+			if err := db.rotateMemtable(); err != nil {
+				db.lock.Unlock()
+				return err
+			}
+		}
+		db.cond.Wait()
+	}
+	db.lock.Unlock()
+
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.lock.Lock()
+	last := 0
+	for level, tables := range db.current.levels {
+		if len(tables) > 0 {
+			last = level
+		}
+	}
+	db.lock.Unlock()
+	// tables that are all in L0 are still merged into L1
+	for level := 0; level < max(last, 1); level++ {
+		db.lock.Lock()
+		c := db.rangeCompaction(level, start, limit)
+		db.lock.Unlock()
+		if c == nil {
+			continue
+		}
+		c.rewrite = true
+		if err := db.runCompaction(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recover opens the tables of the MANIFEST and flushes the logs that weren't flushed to an L0 table.
+func (db *Database) recover() error {
+	m, err := readManifest(db.path)
+	if err != nil {
+		return err
+	}
+	var levels [numLevels][]*table
+	var opened []*table
+	for _, mt := range m.tables {
+		t, err := openTable(db.path, mt.num)
+		if err != nil {
+			for _, t := range opened {
+				t.f.Close()
+			}
+			return err
+		}
+		opened = append(opened, t)
+		levels[mt.level] = append(levels[mt.level], t)
+	}
+	slices.SortFunc(levels[0], func(a, b *table) int {
+		return -cmpNum(a.num, b.num)
+	})
+	for _, tables := range levels[1:] {
+		slices.SortFunc(tables, func(a, b *table) int {
+			return bytes.Compare(a.smallest, b.smallest)
+		})
+	}
+	db.lock.Lock()
+	db.current = newVersion(levels)
+	db.lock.Unlock()
+	db.nextNum = max(m.nextNum, 1)
+	db.logNum = m.logNum
+
+	live := make(map[uint64]bool, len(opened))
+	for _, t := range opened {
+		live[t.num] = true
+	}
+	entries, err := os.ReadDir(db.path)
+	if err != nil {
+		return err
+	}
+	var logs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			if strings.HasSuffix(name, tmpSuffix) {
+				os.Remove(filepath.Join(db.path, name))
+			}
+			continue
+		}
+		db.nextNum = max(db.nextNum, num+1)
+		switch {
+		case ext == logSuffix && num >= db.logNum:
+			logs = append(logs, num)
+		case ext == logSuffix, ext == tableSuffix && !live[num]:
+			// flushed logs and the outputs of an interrupted flush or compaction
+			os.Remove(filepath.Join(db.path, name))
+		}
+	}
+	slices.Sort(logs)
+
+	mem := newMemtable(0)
+	for _, num := range logs {
+		if err := replayWAL(db.path, num, func(ops []batchOp) {
+			for _, op := range ops {
+				mem.apply(op)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	logNum := db.newFileNum()
+	if !mem.empty() {
+		it := newMemIterator(mem.entries, nil)
+		tables, err := db.writeTables(it, false, false)
+		it.Close()
+		if err != nil {
+			return err
+		}
+		levels[0] = append(tables, levels[0]...)
+	}
+	db.lock.Lock()
+	err = db.installVersion(levels, logNum, nil)
+	db.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if db.wal, err = createWAL(db.path, logNum); err != nil {
+		return err
+	}
+	db.mem = newMemtable(logNum)
+	for _, num := range logs {
+		os.Remove(logPath(db.path, num))
+	}
+	return syncDir(db.path)
+}
+
+func cmpNum(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type manifest struct {
+	nextNum uint64
+	logNum  uint64
+	tables  []manifestTable
+}
+
+type manifestTable struct {
+	level int
+	num   uint64
+}
+
+// writeManifest atomically replaces the MANIFEST with a text file of "next N", "log N" and one "table LEVEL N" line per table.
+func writeManifest(dir string, nextNum, logNum uint64, levels [numLevels][]*table) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "next %d\nlog %d\n", nextNum, logNum)
+	for level, tables := range levels {
+		for _, t := range tables {
+			fmt.Fprintf(&b, "table %d %d\n", level, t.num)
+		}
+	}
+	path := filepath.Join(dir, manifestName)
+	f, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readManifest reads the MANIFEST of dir, an empty manifest if there is none.
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var mt manifestTable
+		switch {
+		case strings.HasPrefix(line, "next "):
+			_, err = fmt.Sscanf(line, "next %d", &m.nextNum)
+		case strings.HasPrefix(line, "log "):
+			_, err = fmt.Sscanf(line, "log %d", &m.logNum)
+		case strings.HasPrefix(line, "table "):
+			if _, err = fmt.Sscanf(line, "table %d %d", &mt.level, &mt.num); err == nil && (mt.level < 0 || mt.level >= numLevels) {
+				err = fmt.Errorf("level %d out of range", mt.level)
+			}
+			m.tables = append(m.tables, mt)
+		default:
+			err = errors.New("unknown entry")
+		}
+		if err != nil {
+			return m, fmt.Errorf("%s: %q: %w", manifestName, line, err)
+		}
+	}
+	return m, scanner.Err()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
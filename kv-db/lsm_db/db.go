@@ -0,0 +1,403 @@
+package lsm_db
+
+/* A small LSM-tree: writes go to a write-ahead log and a B-tree memtable. A full memtable becomes immutable,
+a new one with a new log takes the writes, and a background goroutine flushes the immutable one to an L0 table.
+Tables are sorted string tables with a block index and a bloom filter (see sstable.go). L0 tables may overlap
+and are searched newest first, the tables of L1 and below don't overlap and every level is allowed
+LevelMultiplier times the size of the one above it. Leveled compaction merges a level into the next one
+once L0 has too many tables or a level is too large (see compaction.go).
+
+path is a directory of numbered files: NNNNNN.log write-ahead logs and NNNNNN.sst tables. MANIFEST lists the
+live tables per level and the first log that isn't flushed yet, it is replaced atomically after every flush and
+compaction. Opening replays the logs behind the MANIFEST and flushes them to L0.
+
+Reads take the newest value of a key: the memtable, the immutable memtable, L0 newest first, then L1, L2, ...
+A delete writes a tombstone that shadows the older values until compaction drops it in the bottom level.
+There is no block cache, table reads go through the OS page cache.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var errClosed = errors.New("database closed")
+var errNotFound = errors.New("not found")
+
+const numLevels = 7
+
+type Options struct {
+	// Sync makes every write wait for the log to be fsynced, otherwise the log is buffered
+	// and written in walBufferSize chunks or on SyncKeyValue.
+	Sync bool
+
+	// MemTableSize is the size the memtable is flushed at.
+	MemTableSize int
+	// BlockSize is the uncompressed size of the table data blocks.
+	BlockSize int
+	// BloomBitsPerKey of the table bloom filters, 0 disables them.
+	BloomBitsPerKey int
+	// TableSize is the size compaction splits its output tables at.
+	TableSize int64
+	// L0CompactionTrigger is the number of L0 tables that triggers an L0 compaction.
+	L0CompactionTrigger int
+	// L0StopWritesTrigger is the number of L0 tables at which writes wait for compaction.
+	L0StopWritesTrigger int
+	// LevelSize is the maximum size of L1, every level below may be LevelMultiplier times larger.
+	LevelSize       int64
+	LevelMultiplier int
+}
+
+var DefaultOptions = Options{
+	MemTableSize:        4 * 1024 * 1024,
+	BlockSize:           4096,
+	BloomBitsPerKey:     10,
+	TableSize:           2 * 1024 * 1024,
+	L0CompactionTrigger: 4,
+	L0StopWritesTrigger: 12,
+	LevelSize:           10 * 1024 * 1024,
+	LevelMultiplier:     10,
+}
+
+type Database struct {
+	path string
+	opts Options
+
+	lock    sync.Mutex
+	cond    *sync.Cond // signalled when the background goroutine made room for writes
+	mem     *memtable
+	imm     *memtable // being flushed
+	wal     *wal
+	current *version
+	nextNum uint64
+	logNum  uint64 // the oldest log that isn't flushed
+	closed  bool
+	bgErr   error // failure of the background goroutine, writes fail from then on
+
+	bgWork    chan struct{}
+	done      chan struct{}
+	bgWg      sync.WaitGroup
+	compactMu sync.Mutex // held by whoever compacts, the background goroutine or Compact
+
+	compactPointer [numLevels][]byte // largest key of the last table compacted per level
+
+	stats      Stats        // under lock, except for the counters of table reads
+	tableReads atomic.Int64 // Stats.TableReads
+	bloomSkips atomic.Int64 // Stats.BloomFilterSkips
+}
+
+var _ ethdb.KeyValueStore = (*Database)(nil)
+
+// Stats are counters of the database since it was opened.
+type Stats struct {
+	Flushes          int64
+	Compactions      int64
+	TrivialMoves     int64 // compactions that moved a table down without rewriting it
+	BytesFlushed     int64
+	BytesCompacted   int64 // written by compactions
+	BytesLogged      int64 // written to the logs
+	WriteStalls      int64
+	WriteStallTime   time.Duration
+	TableReads       int64 // data blocks read by Get and iterators
+	BloomFilterSkips int64 // tables a Get skipped because of their bloom filter
+}
+
+func NewDatabase(path string) (*Database, error) {
+	return NewDatabaseWithOptions(path, DefaultOptions)
+}
+
+func NewDatabaseWithOptions(path string, opts Options) (*Database, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	db := &Database{
+		path:   path,
+		opts:   opts,
+		bgWork: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	db.cond = sync.NewCond(&db.lock)
+	if err := db.recover(); err != nil {
+		db.current.unref(db)
+		return nil, err
+	}
+	db.bgWg.Add(1)
+	go db.background()
+	db.scheduleWork()
+	return db, nil
+}
+
+// Get retrieves the given key if it's present in the key-value store.
+func (db *Database) Get(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return nil, errClosed
+	}
+	for _, mem := range []*memtable{db.mem, db.imm} {
+		if mem == nil {
+			continue
+		}
+		if e, ok := mem.get(key); ok {
+			db.lock.Unlock()
+			if e.deleted {
+				return nil, errNotFound
+			}
+			// the caller may modify the value
+			return bytes.Clone(e.value), nil
+		}
+	}
+	v := db.current
+	v.refs++
+	db.lock.Unlock()
+
+	value, deleted, found, err := v.get(db, key)
+	db.lock.Lock()
+	v.unref(db)
+	db.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !found || deleted {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+// Has retrieves if a key is present in the key-value store.
+func (db *Database) Has(key []byte) (bool, error) {
+	_, err := db.Get(key)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put inserts the given value into the key-value store.
+func (db *Database) Put(key []byte, value []byte) error {
+	return db.write([]batchOp{{kind: kindSet, key: key, value: value}})
+}
+
+// Delete removes the key from the key-value store.
+func (db *Database) Delete(key []byte) error {
+	return db.write([]batchOp{{kind: kindDelete, key: key}})
+}
+
+// write logs ops as one record and applies them to the memtable.
+func (db *Database) write(ops []batchOp) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.makeRoomForWrite(); err != nil {
+		return err
+	}
+	return db.commit(ops)
+}
+
+// commit logs ops as one record and applies them to the memtable, db.lock must be held and room made for the write.
+func (db *Database) commit(ops []batchOp) error {
+	rec := encodeBatch(ops)
+	if err := db.wal.append(rec); err != nil {
+		return err
+	}
+	db.stats.BytesLogged += int64(len(rec)) + walHeaderSize
+	if db.opts.Sync {
+		if err := db.wal.sync(); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		db.mem.apply(op)
+	}
+	return nil
+}
+
+// makeRoomForWrite switches to a new memtable once the current one is full, and waits for the background goroutine
+// while the previous one is still flushed or L0 has L0StopWritesTrigger tables. db.lock must be held.
+func (db *Database) makeRoomForWrite() error {
+	var stallStart time.Time
+	defer func() {
+		if !stallStart.IsZero() {
+			db.stats.WriteStallTime += time.Since(stallStart)
+		}
+	}()
+	for {
+		if db.closed {
+			return errClosed
+		}
+		if db.bgErr != nil {
+			return db.bgErr
+		}
+		if db.mem.size < db.opts.MemTableSize {
+			return nil
+		}
+		if db.imm != nil || len(db.current.levels[0]) >= db.opts.L0StopWritesTrigger {
+			if stallStart.IsZero() {
+				stallStart = time.Now()
+				db.stats.WriteStalls++
+			}
+			db.cond.Wait()
+			continue
+		}
+		if err := db.rotateMemtable(); err != nil {
+			return err
+		}
+	}
+}
+
+// rotateMemtable makes the memtable immutable and starts a new one with a new log, db.lock must be held.
+func (db *Database) rotateMemtable() error {
+	num := db.nextNum
+	w, err := createWAL(db.path, num)
+	if err != nil {
+		return err
+	}
+	db.nextNum++
+	// the flush makes the old log obsolete, it doesn't have to be synced
+	if err := db.wal.close(); err != nil {
+		w.close()
+		return err
+	}
+	db.wal = w
+	db.imm = db.mem
+	db.mem = newMemtable(num)
+	db.scheduleWork()
+	return nil
+}
+
+func (db *Database) scheduleWork() {
+	select {
+	case db.bgWork <- struct{}{}:
+	default:
+	}
+}
+
+// Sync writes the buffered log records and fsyncs the log.
+func (db *Database) Sync() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return errClosed
+	}
+	return db.wal.sync()
+}
+
+// SyncKeyValue implements ethdb.KeyValueSyncer.
+func (db *Database) SyncKeyValue() error {
+	return db.Sync()
+}
+
+// Stats returns the counters of the database.
+func (db *Database) Stats() Stats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	s := db.stats
+	s.TableReads, s.BloomFilterSkips = db.tableReads.Load(), db.bloomSkips.Load()
+	return s
+}
+
+// Stat returns the tables and sizes per level and the counters of the database.
+func (db *Database) Stat() (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	var b strings.Builder
+	const mib = 1024 * 1024
+	fmt.Fprintf(&b, "memtable %.1fMiB", float64(db.mem.size)/mib)
+	if db.imm != nil {
+		fmt.Fprintf(&b, ", flushing %.1fMiB", float64(db.imm.size)/mib)
+	}
+	b.WriteString("\n")
+	for level, tables := range db.current.levels {
+		if len(tables) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "L%d: %d tables, %.1fMiB\n", level, len(tables), float64(totalSize(tables))/mib)
+	}
+	s := db.stats
+	s.TableReads, s.BloomFilterSkips = db.tableReads.Load(), db.bloomSkips.Load()
+	fmt.Fprintf(&b, "flushes %d (%.1fMiB), compactions %d (%d trivial moves, %.1fMiB), logged %.1fMiB, stalls %d (%v), block reads %d, bloom skips %d",
+		s.Flushes, float64(s.BytesFlushed)/mib, s.Compactions, s.TrivialMoves, float64(s.BytesCompacted)/mib, float64(s.BytesLogged)/mib,
+		s.WriteStalls, s.WriteStallTime.Round(time.Millisecond), s.TableReads, s.BloomFilterSkips)
+	return b.String(), nil
+}
+
+// Close waits for the background goroutine to finish its current flush or compaction, and syncs the log.
+// The memtables are not flushed, they are replayed from the logs on open.
+func (db *Database) Close() error {
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return errClosed
+	}
+	db.closed = true
+	db.cond.Broadcast()
+	db.lock.Unlock()
+	close(db.done)
+	db.bgWg.Wait()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.wal.sync()
+	if cerr := db.wal.close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	db.current.unref(db)
+	if db.bgErr != nil && err == nil {
+		err = db.bgErr
+	}
+	return err
+}
+
+func (db *Database) background() {
+	defer db.bgWg.Done()
+	for {
+		select {
+		case <-db.bgWork:
+		case <-db.done:
+			return
+		}
+		for {
+			worked, err := db.backgroundStep()
+			if err != nil {
+				log.Printf("lsm_db: background work in %s failed: %v", db.path, err)
+				db.lock.Lock()
+				db.bgErr = err
+				db.cond.Broadcast()
+				db.lock.Unlock()
+				return
+			}
+			if !worked {
+				break
+			}
+		}
+	}
+}
+
+// backgroundStep flushes the immutable memtable or runs one compaction, it returns false if there was nothing to do.
+func (db *Database) backgroundStep() (bool, error) {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return false, nil
+	}
+	if db.imm != nil {
+		db.lock.Unlock()
+		return true, db.flush()
+	}
+	c := db.pickCompaction()
+	db.lock.Unlock()
+	if c == nil {
+		return false, nil
+	}
+	return true, db.runCompaction(c)
+}
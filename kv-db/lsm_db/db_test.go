@@ -0,0 +1,430 @@
+package lsm_db
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/dbtest"
+)
+
+// testOptions are small enough for a few thousand writes to flush and compact into several levels.
+var testOptions = Options{
+	MemTableSize:        4096,
+	BlockSize:           256,
+	BloomBitsPerKey:     10,
+	TableSize:           4096,
+	L0CompactionTrigger: 2,
+	L0StopWritesTrigger: 8,
+	LevelSize:           8192,
+	LevelMultiplier:     2,
+}
+
+// model is a map applying the same writes as the database.
+type model map[string]string
+
+func (m model) deleteRange(start, end []byte) {
+	for k := range m {
+		if inRange([]byte(k), start, end) {
+			delete(m, k)
+		}
+	}
+}
+
+func (m model) clone() model {
+	c := make(model, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// sorted returns the keys of m with prefix at or after prefix+start, in order.
+func (m model) sorted(prefix, start string) []string {
+	var keys []string
+	for k := range m {
+		if strings.HasPrefix(k, prefix) && k >= prefix+start {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkState compares db to m with Get and a full iteration.
+func checkState(t *testing.T, db *Database, m model) {
+	t.Helper()
+	for k, v := range m {
+		got, err := db.Get([]byte(k))
+		if err != nil || string(got) != v {
+			t.Fatalf("key %s: got %q %v, want %q", k, got, err, v)
+		}
+	}
+	want := m.sorted("", "")
+	var keys []string
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		if string(it.Value()) != m[string(it.Key())] {
+			t.Fatalf("key %s: iterated %q, want %q", it.Key(), it.Value(), m[string(it.Key())])
+		}
+		keys = append(keys, string(it.Key()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("iterated %d keys, want %d", len(keys), len(want))
+	}
+}
+
+// randomWrites applies n random Puts, Deletes, DeleteRanges and batches to db and m.
+func randomWrites(t *testing.T, rnd *rand.Rand, db *Database, m model, n int) {
+	t.Helper()
+	key := func() []byte { return []byte(fmt.Sprintf("key%04d", rnd.Intn(500))) }
+	for i := 0; i < n; i++ {
+		switch r := rnd.Intn(100); {
+		case r < 60:
+			k, v := key(), fmt.Sprintf("value%d-%s", i, bytes.Repeat([]byte{'x'}, rnd.Intn(50)))
+			if err := db.Put(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			m[string(k)] = v
+		case r < 85:
+			k := key()
+			if err := db.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(m, string(k))
+		case r < 90:
+			start, end := key(), key()
+			if bytes.Compare(start, end) > 0 {
+				start, end = end, start
+			}
+			if err := db.DeleteRange(start, end); err != nil {
+				t.Fatal(err)
+			}
+			m.deleteRange(start, end)
+		default:
+			// a range deletion in a batch sees the writes of the batch before it
+			b := db.NewBatch()
+			k, start := key(), key()
+			end := append(bytes.Clone(start), 0xff)
+			b.Put(k, []byte("batched"))
+			b.Put(start, []byte("batched"))
+			b.DeleteRange(start, end)
+			b.Put(end, []byte("batched"))
+			if err := b.Write(); err != nil {
+				t.Fatal(err)
+			}
+			m[string(k)] = "batched"
+			m[string(start)] = "batched"
+			m.deleteRange(start, end)
+			m[string(end)] = "batched"
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	m := make(model)
+	db, err := NewDatabaseWithOptions(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 4; round++ {
+		randomWrites(t, rnd, db, m, 3000)
+		checkState(t, db, m)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDatabaseWithOptions(dir, testOptions); err != nil {
+			t.Fatal(err)
+		}
+		checkState(t, db, m)
+	}
+	defer db.Close()
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, m)
+}
+
+func TestCompactionAcrossLevels(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(2))
+	m := make(model)
+	db, err := NewDatabaseWithOptions(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 300KB of live data that doesn't fit L1 and L2
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("live%05d", i)
+		if err := db.Put([]byte(k), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		m[k] = value
+	}
+	randomWrites(t, rnd, db, m, 10000)
+	// the levels grew deeper than L1 with the background compactions
+	db.compactMu.Lock()
+	db.lock.Lock()
+	deepest := 0
+	for level, tables := range db.current.levels {
+		if len(tables) > 0 {
+			deepest = level
+		}
+	}
+	db.lock.Unlock()
+	db.compactMu.Unlock()
+	if deepest < 2 {
+		t.Fatalf("the deepest level with tables is L%d", deepest)
+	}
+	if s := db.Stats(); s.Flushes == 0 || s.Compactions == 0 {
+		t.Fatalf("%d flushes and %d compactions", s.Flushes, s.Compactions)
+	}
+	checkState(t, db, m)
+	// Compact merges every level into the deepest one
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.lock.Lock()
+	for level, tables := range db.current.levels[:deepest] {
+		if len(tables) > 0 {
+			t.Errorf("%d tables left in L%d above L%d", len(tables), level, deepest)
+		}
+	}
+	db.lock.Unlock()
+	checkState(t, db, m)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = NewDatabaseWithOptions(dir, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkState(t, db, m)
+}
+
+// lastLog returns the path of the newest log in dir.
+func lastLog(t *testing.T, dir string) string {
+	t.Helper()
+	logs, err := filepath.Glob(filepath.Join(dir, "*"+logSuffix))
+	if err != nil || len(logs) == 0 {
+		t.Fatalf("no log in %s: %v", dir, err)
+	}
+	sort.Strings(logs)
+	return logs[len(logs)-1]
+}
+
+func TestTornLogTail(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(3))
+	m := make(model)
+	db, err := NewDatabaseWithOptions(dir, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomWrites(t, rnd, db, m, 1000)
+	before := m.clone()
+	b := db.NewBatch()
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("torn%d", i)
+		b.Put([]byte(k), []byte("lost"))
+		m[k] = "lost"
+	}
+	b.Delete([]byte("key0001"))
+	if err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch was the last record, cutting off its last byte drops it as a whole
+	path := lastLog(t, dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = NewDatabaseWithOptions(dir, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, before)
+	// the database keeps working after the torn tail
+	randomWrites(t, rnd, db, before, 500)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// garbage behind the last record is dropped and the records stay
+	f, err := os.OpenFile(lastLog(t, dir), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{1, 2, 3, 4, 0, 0, 0, 9, 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = NewDatabaseWithOptions(dir, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkState(t, db, before)
+}
+
+func TestIteratorBounds(t *testing.T) {
+	db, err := NewDatabaseWithOptions(t.TempDir(), testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := make(model)
+	// the keys are spread over the memtable and the tables of several levels
+	rnd := rand.New(rand.NewSource(4))
+	randomWrites(t, rnd, db, m, 5000)
+	for _, k := range []string{"", "a", "a\x00", "ab", "abc", "ac", "b", "b\xff", "b\xff\xff", "c\xff"} {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatal(err)
+		}
+		m[k] = "v" + k
+	}
+	for _, c := range []struct{ prefix, start string }{
+		{"", ""}, {"a", ""}, {"a", "b"}, {"a", "bd"}, {"ab", ""}, {"", "ab"}, {"b\xff", ""}, {"c\xff", ""},
+		{"key", "0250"}, {"key02", "5"}, {"key", "9"}, {"", "zz"}, {"x", ""},
+	} {
+		want := m.sorted(c.prefix, c.start)
+		var keys []string
+		it := db.NewIterator([]byte(c.prefix), []byte(c.start))
+		for it.Next() {
+			if string(it.Value()) != m[string(it.Key())] {
+				t.Fatalf("key %q: got %q, want %q", it.Key(), it.Value(), m[string(it.Key())])
+			}
+			keys = append(keys, string(it.Key()))
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		it.Release()
+		if fmt.Sprint(keys) != fmt.Sprint(want) {
+			t.Fatalf("prefix %q start %q: got %d keys %q, want %d", c.prefix, c.start, len(keys), keys, len(want))
+		}
+	}
+}
+
+// tableEntries counts the entries of the tables of the current version, tombstones included.
+func tableEntries(t *testing.T, db *Database) int {
+	t.Helper()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	n := 0
+	for _, tables := range db.current.levels {
+		for _, table := range tables {
+			it := newTableIterator(db, table, nil)
+			for it.Next() {
+				n++
+			}
+			if err := it.Error(); err != nil {
+				t.Fatal(err)
+			}
+			it.Close()
+		}
+	}
+	return n
+}
+
+func TestCompactL0Only(t *testing.T) {
+	opts := testOptions
+	// the background goroutine leaves L0 alone
+	opts.L0CompactionTrigger = 100
+	opts.L0StopWritesTrigger = 100
+	db, err := NewDatabaseWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m := make(model)
+	rnd := rand.New(rand.NewSource(5))
+	for round := 0; round < 3; round++ {
+		randomWrites(t, rnd, db, m, 300)
+		// every round ends up in its own L0 table, rotateMemtable expects the last one to be flushed
+		db.lock.Lock()
+		for db.imm != nil {
+			db.cond.Wait()
+		}
+		err := db.rotateMemtable()
+		db.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.lock.Lock()
+	for db.imm != nil {
+		db.cond.Wait()
+	}
+	l0 := len(db.current.levels[0])
+	db.lock.Unlock()
+	if l0 < 3 {
+		t.Fatalf("%d L0 tables before Compact", l0)
+	}
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.lock.Lock()
+	l0, l1 := len(db.current.levels[0]), len(db.current.levels[1])
+	db.lock.Unlock()
+	if l0 != 0 || l1 == 0 {
+		t.Fatalf("%d L0 and %d L1 tables after Compact", l0, l1)
+	}
+	if s := db.Stats(); s.Compactions == 0 {
+		t.Fatal("Compact ran no compaction")
+	}
+	// the tombstones and overwritten values are gone
+	if n := tableEntries(t, db); n != len(m) {
+		t.Fatalf("%d entries in the tables, want %d", n, len(m))
+	}
+	checkState(t, db, m)
+
+	// a single L0 table is rewritten too, not moved down with its tombstones
+	for k := range m {
+		if err := db.Delete([]byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		delete(m, k)
+		if len(m) == 10 {
+			break
+		}
+	}
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := tableEntries(t, db); n != len(m) {
+		t.Fatalf("%d entries in the tables, want %d", n, len(m))
+	}
+	checkState(t, db, m)
+}
+
+func TestDatabaseSuite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ethdb.KeyValueStore {
+		db, err := NewDatabaseWithOptions(t.TempDir(), testOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
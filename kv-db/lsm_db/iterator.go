@@ -0,0 +1,266 @@
+package lsm_db
+
+/* An iterator merges a clone of the memtable, the immutable memtable and the tables of the current version,
+so it sees the database as of NewIterator. The version is referenced until Release, which keeps its tables
+on disk while compactions replace them.
+*/
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// internalIterator walks the entries of a memtable or table in key order, including tombstones.
+type internalIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Deleted() bool
+	Error() error
+	Close()
+}
+
+// mergingIterator merges iterators given newest first, of the entries with the same key it returns the newest one.
+type mergingIterator struct {
+	iters   []internalIterator
+	heap    mergeHeap
+	cur     []byte // key of the current entry
+	started bool
+	err     error
+}
+
+func newMergingIterator(iters []internalIterator) *mergingIterator {
+	return &mergingIterator{iters: iters}
+}
+
+func (m *mergingIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, it := range m.iters {
+			if it.Next() {
+				m.heap = append(m.heap, mergeItem{it, i})
+			} else if m.err = it.Error(); m.err != nil {
+				return false
+			}
+		}
+		heap.Init(&m.heap)
+	} else {
+		// skip the current key in all iterators, the older ones have it shadowed
+		for len(m.heap) > 0 && bytes.Equal(m.heap[0].it.Key(), m.cur) {
+			if m.heap[0].it.Next() {
+				heap.Fix(&m.heap, 0)
+			} else if m.err = m.heap[0].it.Error(); m.err != nil {
+				return false
+			} else {
+				heap.Pop(&m.heap)
+			}
+		}
+	}
+	if len(m.heap) == 0 {
+		return false
+	}
+	m.cur = append(m.cur[:0], m.heap[0].it.Key()...)
+	return true
+}
+
+func (m *mergingIterator) Key() []byte   { return m.heap[0].it.Key() }
+func (m *mergingIterator) Value() []byte { return m.heap[0].it.Value() }
+func (m *mergingIterator) Deleted() bool { return m.heap[0].it.Deleted() }
+func (m *mergingIterator) Error() error  { return m.err }
+
+func (m *mergingIterator) Close() {
+	for _, it := range m.iters {
+		it.Close()
+	}
+}
+
+type mergeItem struct {
+	it  internalIterator
+	age int // index in mergingIterator.iters, lower is newer
+}
+
+// mergeHeap orders by key, then newest first.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].it.Key(), h[j].it.Key()); c != 0 {
+		return c < 0
+	}
+	return h[i].age < h[j].age
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// levelIterator walks the non-overlapping tables of a level one after the other.
+type levelIterator struct {
+	db     *Database
+	tables []*table
+	start  []byte
+	cur    *tableIterator
+	err    error
+}
+
+func newLevelIterator(db *Database, tables []*table, start []byte) *levelIterator {
+	// skip the tables that end before start
+	for len(tables) > 0 && bytes.Compare(tables[0].largest, start) < 0 {
+		tables = tables[1:]
+	}
+	return &levelIterator{db: db, tables: tables, start: start}
+}
+
+func (it *levelIterator) Next() bool {
+	for {
+		if it.cur != nil {
+			if it.cur.Next() {
+				return true
+			}
+			if it.err = it.cur.Error(); it.err != nil {
+				return false
+			}
+		}
+		if len(it.tables) == 0 {
+			it.cur = nil
+			return false
+		}
+		it.cur = newTableIterator(it.db, it.tables[0], it.start)
+		it.tables, it.start = it.tables[1:], nil
+	}
+}
+
+func (it *levelIterator) Key() []byte   { return it.cur.Key() }
+func (it *levelIterator) Value() []byte { return it.cur.Value() }
+func (it *levelIterator) Deleted() bool { return it.cur.Deleted() }
+func (it *levelIterator) Error() error  { return it.err }
+func (it *levelIterator) Close()        {}
+
+type iterator struct {
+	db       *Database
+	v        *version
+	merged   *mergingIterator
+	limit    []byte // exclusive upper bound, nil is unbounded
+	key      []byte
+	value    []byte
+	err      error
+	released bool
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset
+// of database content with a particular key prefix, starting at a particular
+// initial key (or after, if it does not exist).
+func (db *Database) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.newIterator(prefix, start)
+}
+
+// newIterator is NewIterator, db.lock must be held.
+func (db *Database) newIterator(prefix []byte, start []byte) *iterator {
+	if db.closed {
+		return &iterator{err: errClosed, released: true}
+	}
+	from := append(bytes.Clone(prefix), start...)
+	iters := []internalIterator{newMemIterator(db.mem.entries.Clone(), from)}
+	if db.imm != nil {
+		iters = append(iters, newMemIterator(db.imm.entries, from))
+	}
+	v := db.current
+	v.refs++
+	for _, t := range v.levels[0] {
+		iters = append(iters, newTableIterator(db, t, from))
+	}
+	for _, tables := range v.levels[1:] {
+		if len(tables) > 0 {
+			iters = append(iters, newLevelIterator(db, tables, from))
+		}
+	}
+	return &iterator{db: db, v: v, merged: newMergingIterator(iters), limit: upperBound(prefix)}
+}
+
+// upperBound returns the upper bound for the given prefix
+func upperBound(prefix []byte) (limit []byte) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		c := prefix[i]
+		if c == 0xff {
+			continue
+		}
+		limit = make([]byte, i+1)
+		copy(limit, prefix)
+		limit[i] = c + 1
+		break
+	}
+	return limit
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (it *iterator) Next() bool {
+	if it.err != nil || it.released {
+		return false
+	}
+	for it.merged.Next() {
+		if it.limit != nil && bytes.Compare(it.merged.Key(), it.limit) >= 0 {
+			break
+		}
+		if it.merged.Deleted() {
+			continue
+		}
+		it.key, it.value = it.merged.Key(), it.merged.Value()
+		return true
+	}
+	it.key, it.value, it.err = nil, nil, it.merged.Error()
+	return false
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (it *iterator) Error() error {
+	return it.err
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (it *iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (it *iterator) Value() []byte {
+	return it.value
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (it *iterator) Release() {
+	if it.released {
+		return
+	}
+	it.db.lock.Lock()
+	it.release()
+	it.db.lock.Unlock()
+}
+
+// release is Release, db.lock must be held.
+func (it *iterator) release() {
+	if it.released {
+		return
+	}
+	it.released = true
+	it.merged.Close()
+	it.key, it.value = nil, nil
+	it.v.unref(it.db)
+}
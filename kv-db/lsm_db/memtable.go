@@ -0,0 +1,80 @@
+package lsm_db
+
+import (
+	"iter"
+	"strings"
+
+	"github.com/RaduBerinde/btreemap"
+)
+
+// memEntryOverhead approximates the memory a memtable entry costs besides its key and value.
+const memEntryOverhead = 48
+
+type memEntry struct {
+	value   []byte
+	deleted bool
+}
+
+// memtable holds the writes of one log, ordered by key. It is written under db.lock and immutable once it's flushed.
+type memtable struct {
+	entries *btreemap.BTreeMap[string, memEntry]
+	size    int
+	logNum  uint64
+}
+
+func newMemtable(logNum uint64) *memtable {
+	return &memtable{
+		entries: btreemap.New[string, memEntry](32, strings.Compare),
+		logNum:  logNum,
+	}
+}
+
+func (m *memtable) apply(op batchOp) {
+	e := memEntry{deleted: op.kind == kindDelete}
+	if !e.deleted {
+		e.value = append([]byte{}, op.value...)
+	}
+	// the replaced entry still counts, like the log it is in
+	m.entries.ReplaceOrInsert(string(op.key), e)
+	m.size += len(op.key) + len(op.value) + memEntryOverhead
+}
+
+func (m *memtable) get(key []byte) (memEntry, bool) {
+	_, e, ok := m.entries.Get(string(key))
+	return e, ok
+}
+
+func (m *memtable) empty() bool {
+	return m.entries.Len() == 0
+}
+
+// memIterator walks a memtable from a start key.
+type memIterator struct {
+	next func() (string, memEntry, bool)
+	stop func()
+	k    []byte
+	e    memEntry
+}
+
+// newMemIterator iterates over entries, which must not be modified meanwhile: an immutable memtable or a clone.
+func newMemIterator(entries *btreemap.BTreeMap[string, memEntry], start []byte) *memIterator {
+	it := new(memIterator)
+	it.next, it.stop = iter.Pull2(entries.Ascend(btreemap.GE(string(start)), btreemap.Max[string]()))
+	return it
+}
+
+func (it *memIterator) Next() bool {
+	key, e, ok := it.next()
+	if !ok {
+		it.k, it.e = nil, memEntry{}
+		return false
+	}
+	it.k, it.e = []byte(key), e
+	return true
+}
+
+func (it *memIterator) Key() []byte   { return it.k }
+func (it *memIterator) Value() []byte { return it.e.value }
+func (it *memIterator) Deleted() bool { return it.e.deleted }
+func (it *memIterator) Error() error  { return nil }
+func (it *memIterator) Close()        { it.stop() }
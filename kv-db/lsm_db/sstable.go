@@ -0,0 +1,403 @@
+package lsm_db
+
+/* A table NNNNNN.sst is a sequence of blocks followed by a footer, every block ends with the CRC-32C of its contents.
+Data blocks hold sorted entries kind(1) | keySize(uvarint) | valueSize(uvarint) | key | value, a new block
+starts once one reaches Options.BlockSize. The filter block is the bloom filter of all keys. The index block is
+entries(uvarint) | smallestKey(uvarint size | key) followed by one handle per data block:
+lastKey(uvarint size | key) | offset(uvarint) | size(uvarint).
+The footer is filterOff(8) | filterSize(8) | indexOff(8) | indexSize(8) | magic(8), block sizes exclude the CRC.
+
+Opening a table keeps its index and filter in memory, a Get reads at most one data block.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	tableSuffix = ".sst"
+	footerSize  = 40
+	tableMagic  = 0x6c736d5f73737431 // "lsm_sst1"
+	crcSize     = 4
+)
+
+var errCorrupt = errors.New("corrupt table")
+
+func tablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, tableSuffix))
+}
+
+type blockHandle struct {
+	lastKey []byte
+	off     int64
+	size    int
+}
+
+type table struct {
+	num      uint64
+	f        *os.File
+	size     int64
+	entries  uint64
+	smallest []byte
+	largest  []byte
+	index    []blockHandle
+	filter   bloom
+	refs     int  // versions holding the table
+	obsolete bool // compacted away, deleted once the last version holding it is released
+}
+
+// tableWriter writes a table in one pass, entries must be added in key order.
+type tableWriter struct {
+	path     string
+	f        *os.File
+	w        *bufio.Writer
+	opts     *Options
+	off      int64
+	block    []byte
+	lastKey  []byte
+	smallest []byte
+	index    []blockHandle
+	hashes   []uint32
+	entries  uint64
+}
+
+func newTableWriter(dir string, num uint64, opts *Options) (*tableWriter, error) {
+	path := tablePath(dir, num)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{path: path, f: f, w: bufio.NewWriterSize(f, 256*1024), opts: opts}, nil
+}
+
+func (tw *tableWriter) add(key, value []byte, deleted bool) error {
+	if tw.entries == 0 {
+		tw.smallest = append([]byte{}, key...)
+	}
+	kind := kindSet
+	if deleted {
+		kind = kindDelete
+		value = nil
+	}
+	tw.block = append(tw.block, kind)
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(key)))
+	tw.block = binary.AppendUvarint(tw.block, uint64(len(value)))
+	tw.block = append(tw.block, key...)
+	tw.block = append(tw.block, value...)
+	tw.lastKey = append(tw.lastKey[:0], key...)
+	if tw.opts.BloomBitsPerKey > 0 {
+		tw.hashes = append(tw.hashes, bloomHash(key))
+	}
+	tw.entries++
+	if len(tw.block) >= tw.opts.BlockSize {
+		return tw.finishBlock()
+	}
+	return nil
+}
+
+// size is the size of the table written so far.
+func (tw *tableWriter) size() int64 {
+	return tw.off + int64(len(tw.block))
+}
+
+func (tw *tableWriter) writeBlock(data []byte) (int64, error) {
+	off := tw.off
+	if _, err := tw.w.Write(data); err != nil {
+		return 0, err
+	}
+	if _, err := tw.w.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crcTable))); err != nil {
+		return 0, err
+	}
+	tw.off += int64(len(data)) + crcSize
+	return off, nil
+}
+
+func (tw *tableWriter) finishBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+	off, err := tw.writeBlock(tw.block)
+	if err != nil {
+		return err
+	}
+	tw.index = append(tw.index, blockHandle{lastKey: append([]byte{}, tw.lastKey...), off: off, size: len(tw.block)})
+	tw.block = tw.block[:0]
+	return nil
+}
+
+// finish writes the filter, index and footer, syncs the table and opens it for reading.
+func (tw *tableWriter) finish(num uint64) (*table, error) {
+	if err := tw.finishBlock(); err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	var filter bloom
+	if tw.opts.BloomBitsPerKey > 0 {
+		filter = newBloom(tw.hashes, tw.opts.BloomBitsPerKey)
+	}
+	filterOff, err := tw.writeBlock(filter)
+	if err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	index := binary.AppendUvarint(nil, tw.entries)
+	index = appendBytes(index, tw.smallest)
+	for _, h := range tw.index {
+		index = appendBytes(index, h.lastKey)
+		index = binary.AppendUvarint(index, uint64(h.off))
+		index = binary.AppendUvarint(index, uint64(h.size))
+	}
+	indexOff, err := tw.writeBlock(index)
+	if err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[0:], uint64(filterOff))
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(filter)))
+	binary.BigEndian.PutUint64(footer[16:], uint64(indexOff))
+	binary.BigEndian.PutUint64(footer[24:], uint64(len(index)))
+	binary.BigEndian.PutUint64(footer[32:], tableMagic)
+	if _, err := tw.w.Write(footer); err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	if err := tw.w.Flush(); err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	if err := tw.f.Sync(); err != nil {
+		tw.abandon()
+		return nil, err
+	}
+	if err := tw.f.Close(); err != nil {
+		os.Remove(tw.path)
+		return nil, err
+	}
+	return openTable(filepath.Dir(tw.path), num)
+}
+
+// abandon closes and deletes the unfinished table.
+func (tw *tableWriter) abandon() {
+	tw.f.Close()
+	os.Remove(tw.path)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func openTable(dir string, num uint64) (*table, error) {
+	f, err := os.Open(tablePath(dir, num))
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadTable(f, num)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", tablePath(dir, num), err)
+	}
+	return t, nil
+}
+
+func loadTable(f *os.File, num uint64) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := &table{num: num, f: f, size: info.Size()}
+	if t.size < footerSize {
+		return nil, errCorrupt
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, t.size-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(footer[32:]) != tableMagic {
+		return nil, errCorrupt
+	}
+	if t.filter, err = t.readBlock(int64(binary.BigEndian.Uint64(footer[0:])), int(binary.BigEndian.Uint64(footer[8:]))); err != nil {
+		return nil, err
+	}
+	index, err := t.readBlock(int64(binary.BigEndian.Uint64(footer[16:])), int(binary.BigEndian.Uint64(footer[24:])))
+	if err != nil {
+		return nil, err
+	}
+	var l int
+	if t.entries, l = binary.Uvarint(index); l <= 0 {
+		return nil, errCorrupt
+	}
+	index = index[l:]
+	var ok bool
+	if t.smallest, index, ok = readBytes(index); !ok {
+		return nil, errCorrupt
+	}
+	for len(index) > 0 {
+		var h blockHandle
+		if h.lastKey, index, ok = readBytes(index); !ok {
+			return nil, errCorrupt
+		}
+		off, l1 := binary.Uvarint(index)
+		if l1 <= 0 {
+			return nil, errCorrupt
+		}
+		size, l2 := binary.Uvarint(index[l1:])
+		if l2 <= 0 {
+			return nil, errCorrupt
+		}
+		index = index[l1+l2:]
+		h.off, h.size = int64(off), int(size)
+		t.index = append(t.index, h)
+	}
+	if len(t.index) == 0 {
+		return nil, errCorrupt
+	}
+	t.largest = t.index[len(t.index)-1].lastKey
+	return t, nil
+}
+
+// readBlock reads the block at off and verifies its checksum.
+func (t *table) readBlock(off int64, size int) ([]byte, error) {
+	buf := make([]byte, size+crcSize)
+	if _, err := t.f.ReadAt(buf, off); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errCorrupt
+		}
+		return nil, err
+	}
+	if crc32.Checksum(buf[:size], crcTable) != binary.BigEndian.Uint32(buf[size:]) {
+		return nil, errCorrupt
+	}
+	return buf[:size], nil
+}
+
+// findBlock returns the index of the first block that may contain keys at or after key, len(t.index) if there is none.
+func (t *table) findBlock(key []byte) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return bytes.Compare(t.index[i].lastKey, key) >= 0
+	})
+}
+
+// get looks key up in the table, found is false if the table has no entry for it.
+func (t *table) get(db *Database, key []byte) (value []byte, deleted, found bool, err error) {
+	if !t.filter.mayContain(key) {
+		db.bloomSkips.Add(1)
+		return nil, false, false, nil
+	}
+	i := t.findBlock(key)
+	if i == len(t.index) {
+		return nil, false, false, nil
+	}
+	block, err := t.readBlock(t.index[i].off, t.index[i].size)
+	db.tableReads.Add(1)
+	if err != nil {
+		return nil, false, false, err
+	}
+	it := blockIterator{data: block}
+	for it.next() {
+		switch bytes.Compare(it.key, key) {
+		case 0:
+			return it.value, it.deleted, true, nil
+		case 1:
+			return nil, false, false, nil
+		}
+	}
+	return nil, false, false, it.err
+}
+
+func (t *table) overlaps(start, end []byte) bool {
+	return bytes.Compare(t.largest, start) >= 0 && bytes.Compare(t.smallest, end) <= 0
+}
+
+// blockIterator decodes the entries of a data block.
+type blockIterator struct {
+	data    []byte
+	key     []byte
+	value   []byte
+	deleted bool
+	err     error
+}
+
+func (it *blockIterator) next() bool {
+	if len(it.data) == 0 {
+		return false
+	}
+	kind := it.data[0]
+	keySize, l1 := binary.Uvarint(it.data[1:])
+	if l1 <= 0 {
+		it.err = errCorrupt
+		return false
+	}
+	valueSize, l2 := binary.Uvarint(it.data[1+l1:])
+	if l2 <= 0 {
+		it.err = errCorrupt
+		return false
+	}
+	data := it.data[1+l1+l2:]
+	if uint64(len(data)) < keySize+valueSize {
+		it.err = errCorrupt
+		return false
+	}
+	it.key, it.value, it.deleted = data[:keySize], data[keySize:keySize+valueSize], kind == kindDelete
+	it.data = data[keySize+valueSize:]
+	return true
+}
+
+// tableIterator walks a table from a start key, reading one data block at a time.
+type tableIterator struct {
+	db    *Database
+	t     *table
+	start []byte
+	block int
+	it    blockIterator
+	err   error
+}
+
+func newTableIterator(db *Database, t *table, start []byte) *tableIterator {
+	return &tableIterator{db: db, t: t, start: start, block: t.findBlock(start) - 1}
+}
+
+func (it *tableIterator) Next() bool {
+	for {
+		if it.it.next() {
+			if it.start != nil {
+				if bytes.Compare(it.it.key, it.start) < 0 {
+					continue
+				}
+				it.start = nil
+			}
+			return true
+		}
+		if it.it.err != nil {
+			it.err = it.it.err
+			return false
+		}
+		if it.block++; it.block >= len(it.t.index) {
+			return false
+		}
+		h := it.t.index[it.block]
+		data, err := it.t.readBlock(h.off, h.size)
+		it.db.tableReads.Add(1)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.it = blockIterator{data: data}
+	}
+}
+
+func (it *tableIterator) Key() []byte   { return it.it.key }
+func (it *tableIterator) Value() []byte { return it.it.value }
+func (it *tableIterator) Deleted() bool { return it.it.deleted }
+func (it *tableIterator) Error() error  { return it.err }
+func (it *tableIterator) Close()        {}
@@ -0,0 +1,174 @@
+package lsm_db
+
+/* A log is a sequence of records crc(4) | size(4) | batch, crc is the CRC-32C of everything behind it.
+Every write is one batch record: a batch is a sequence of entries kind(1) | keySize(uvarint) | key, followed by
+valueSize(uvarint) | value for kindSet. Replay stops at the first torn or corrupt record and drops the rest
+of the log, so a batch is replayed all or nothing.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	walHeaderSize = 8
+	walBufferSize = 256 * 1024
+	logSuffix     = ".log"
+)
+
+const (
+	kindDelete byte = iota
+	kindSet
+)
+
+type batchOp struct {
+	kind  byte
+	key   []byte
+	value []byte
+}
+
+func logPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, logSuffix))
+}
+
+type wal struct {
+	num uint64
+	f   *os.File
+	buf []byte // records that aren't written yet
+}
+
+func createWAL(dir string, num uint64) (*wal, error) {
+	f, err := os.OpenFile(logPath(dir, num), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{num: num, f: f}, nil
+}
+
+func encodeBatch(ops []batchOp) []byte {
+	size := 0
+	for _, op := range ops {
+		size += 1 + 2*binary.MaxVarintLen32 + len(op.key) + len(op.value)
+	}
+	buf := make([]byte, 0, size)
+	for _, op := range ops {
+		buf = append(buf, op.kind)
+		buf = binary.AppendUvarint(buf, uint64(len(op.key)))
+		buf = append(buf, op.key...)
+		if op.kind == kindSet {
+			buf = binary.AppendUvarint(buf, uint64(len(op.value)))
+			buf = append(buf, op.value...)
+		}
+	}
+	return buf
+}
+
+func decodeBatch(data []byte) ([]batchOp, error) {
+	var ops []batchOp
+	for len(data) > 0 {
+		op := batchOp{kind: data[0]}
+		data = data[1:]
+		if op.kind != kindSet && op.kind != kindDelete {
+			return nil, fmt.Errorf("unknown batch entry kind %d", op.kind)
+		}
+		var ok bool
+		if op.key, data, ok = readBytes(data); !ok {
+			return nil, errors.New("truncated batch key")
+		}
+		if op.kind == kindSet {
+			if op.value, data, ok = readBytes(data); !ok {
+				return nil, errors.New("truncated batch value")
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// readBytes reads a uvarint length and that many bytes.
+func readBytes(data []byte) ([]byte, []byte, bool) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || uint64(len(data)-l) < n {
+		return nil, nil, false
+	}
+	data = data[l:]
+	return data[:n], data[n:], true
+}
+
+func (w *wal) append(batch []byte) error {
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(batch)))
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, batch)
+	binary.BigEndian.PutUint32(header, crc)
+	w.buf = append(w.buf, header...)
+	w.buf = append(w.buf, batch...)
+	if len(w.buf) >= walBufferSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *wal) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.f.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *wal) sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// close writes the buffered records and closes the log without syncing it.
+func (w *wal) close() error {
+	err := w.flush()
+	if cerr := w.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replayWAL calls fn for the batches of log num up to the first torn or corrupt record.
+func replayWAL(dir string, num uint64, fn func([]batchOp)) error {
+	data, err := os.ReadFile(logPath(dir, num))
+	if err != nil {
+		return err
+	}
+	off := 0
+	for off < len(data) {
+		if len(data)-off < walHeaderSize {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(data[off+4:]))
+		if len(data)-off-walHeaderSize < size {
+			break
+		}
+		end := off + walHeaderSize + size
+		if crc32.Checksum(data[off+4:end], crcTable) != binary.BigEndian.Uint32(data[off:]) {
+			break
+		}
+		ops, err := decodeBatch(data[off+walHeaderSize : end])
+		if err != nil {
+			break
+		}
+		fn(ops)
+		off = end
+	}
+	if off < len(data) {
+		log.Printf("lsm_db: dropping %d bytes of torn or corrupt records at the end of %s", len(data)-off, logPath(dir, num))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package pebble_api
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	pebblev2 "github.com/cockroachdb/pebble/v2"
+)
+
+// Stats is a summary of pebble.Metrics that explains throughput changes.
+type Stats struct {
+	CompactionDebt        uint64  // estimated bytes to compact until the LSM is in shape
+	Compactions           int64   // finished and running
+	CompactionsInProgress int64   // running
+	ReadAmp               int     // L0 sublevels plus non-empty levels a read may have to check
+	WriteAmp              float64 // bytes flushed and compacted per byte written to the WAL
+	CacheHitRate          float64 // of the block cache, between 0 and 1
+	MemTables             int64
+	MemTableSize          uint64
+	MemTableStalls        int64 // write stalls because MemTableLimit was reached
+	L0Stalls              int64 // write stalls because L0 had too many sublevels
+	StallTime             time.Duration
+	DiskUsage             uint64
+}
+
+// Stats returns the current statistics of the database.
+func (d *PebbleV2) Stats() Stats {
+	m := d.db.Metrics()
+	total := m.Total()
+	s := Stats{
+		CompactionDebt:        m.Compact.EstimatedDebt,
+		Compactions:           m.Compact.Count,
+		CompactionsInProgress: m.Compact.NumInProgress,
+		ReadAmp:               m.ReadAmp(),
+		WriteAmp:              total.WriteAmp(),
+		MemTables:             m.MemTable.Count,
+		MemTableSize:          m.MemTable.Size,
+		MemTableStalls:        d.memTableStalls.Load(),
+		L0Stalls:              d.l0Stalls.Load(),
+		StallTime:             time.Duration(d.writeDelayTime.Load()),
+		DiskUsage:             m.DiskSpaceUsage(),
+	}
+	if lookups := m.BlockCache.Hits + m.BlockCache.Misses; lookups > 0 {
+		s.CacheHitRate = float64(m.BlockCache.Hits) / float64(lookups)
+	}
+	return s
+}
+
+func (s Stats) String() string {
+	const mib = 1024 * 1024
+	return fmt.Sprintf("debt=%.1fMiB compactions=%d(%d running) readamp=%d writeamp=%.2f cachehit=%.1f%% memtables=%d(%.1fMiB) stalls=%d memtable/%d L0 stalled=%v disk=%.1fMiB",
+		float64(s.CompactionDebt)/mib, s.Compactions, s.CompactionsInProgress, s.ReadAmp, s.WriteAmp, s.CacheHitRate*100,
+		s.MemTables, float64(s.MemTableSize)/mib, s.MemTableStalls, s.L0Stalls, s.StallTime.Round(time.Millisecond), float64(s.DiskUsage)/mib)
+}
+
+// pebble calls the write stall hooks one after the other, so writeDelayStartTime needs no lock.
+func (d *PebbleV2) onWriteStallBegin(b pebblev2.WriteStallBeginInfo) {
+	d.writeDelayStartTime = time.Now()
+	// The reason is either "memtable count limit reached" or "L0 file count limit exceeded".
+	if strings.HasPrefix(b.Reason, "memtable") {
+		d.memTableStalls.Add(1)
+	} else {
+		d.l0Stalls.Add(1)
+	}
+}
+
+func (d *PebbleV2) onWriteStallEnd() {
+	d.writeDelayTime.Add(int64(time.Since(d.writeDelayStartTime)))
+}
+
+// meter logs the Stats every refresh until Close.
+func (d *PebbleV2) meter(refresh time.Duration) {
+	defer d.meterWg.Done()
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("pebblev2 %s: %v", d.fn, d.Stats())
+		case <-d.done:
+			return
+		}
+	}
+}
@@ -1,32 +1,109 @@
 package pebble_api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pebblev2 "github.com/cockroachdb/pebble/v2"
 	"github.com/cockroachdb/pebble/v2/bloom"
 	"github.com/ethereum/go-ethereum/ethdb"
 )
 
+// PebbleV2 is a persistent key-value store based on the pebble v2 storage engine,
+// implementing ethdb.KeyValueStore like go-ethereum's ethdb/pebble.
 type PebbleV2 struct {
+	fn           string       // filename for reporting
 	db           *pebblev2.DB // Underlying pebble storage engine
 	writeOptions *pebblev2.WriteOptions
+
+	quitLock sync.RWMutex // Mutex protecting the closed flag
+	closed   bool         // keep track of whether we're Closed
+
+	done    chan struct{} // stops the metrics logger
+	meterWg sync.WaitGroup
+
+	writeDelayStartTime time.Time    // The start time of the latest write stall
+	memTableStalls      atomic.Int64 // Write stalls because the memtable limit was reached
+	l0Stalls            atomic.Int64 // Write stalls because L0 had too many sublevels
+	writeDelayTime      atomic.Int64 // Total time spent in write stalls
+}
+
+var _ ethdb.KeyValueStore = (*PebbleV2)(nil)
+
+type Options struct {
+	// Cache is the memory allowance in MiB, shared by the block cache and the memtables.
+	Cache int
+	// Handles is the maximum number of open files.
+	Handles int
+	// Sync makes every write wait for the WAL to be fsynced, otherwise writes use NoSync.
+	Sync bool
+
+	// BlockSize of the L0 sstables, it doubles with every level below.
+	BlockSize int
+	// BloomBitsPerKey of the per-level bloom filters, 0 disables them.
+	BloomBitsPerKey int
+	// L0CompactionThreshold is the L0 read amplification that triggers an L0 compaction.
+	L0CompactionThreshold int
+	// MemTableLimit is the number of memtables at which writes stop until one is flushed.
+	MemTableLimit int
+
+	// MetricsInterval logs Stats this often, 0 disables the logger.
+	MetricsInterval time.Duration
+}
+
+var DefaultOptions = Options{
+	Cache:                 512,
+	BlockSize:             2 * 1024 * 1024,
+	BloomBitsPerKey:       10,
+	L0CompactionThreshold: 2,
+	MemTableLimit:         4,
+}
+
+// New opens a PebbleV2 database with DefaultOptions, with sync every write waits for the WAL to be fsynced.
+func New(file string, cache int, handles int, sync bool) (*PebbleV2, error) {
+	opts := DefaultOptions
+	opts.Cache = cache
+	opts.Handles = handles
+	opts.Sync = sync
+	return NewWithOptions(file, opts)
 }
 
-func New(file string, cache int, handles int) (*PebbleV2, error) {
+// NewWithOptions opens a PebbleV2 database, the zero sizes of opts are taken from DefaultOptions.
+func NewWithOptions(file string, opts Options) (*PebbleV2, error) {
+	if opts.Cache == 0 {
+		opts.Cache = DefaultOptions.Cache
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultOptions.BlockSize
+	}
+	if opts.L0CompactionThreshold == 0 {
+		opts.L0CompactionThreshold = DefaultOptions.L0CompactionThreshold
+	}
+	if opts.MemTableLimit == 0 {
+		opts.MemTableLimit = DefaultOptions.MemTableLimit
+	}
+	if opts.Cache < 0 || opts.MemTableLimit < 1 {
+		return nil, fmt.Errorf("invalid cache of %dMiB or memtable limit of %d", opts.Cache, opts.MemTableLimit)
+	}
+	cache, memTableLimit := opts.Cache, opts.MemTableLimit
 	maxMemTableSize := (1<<31)<<(^uint(0)>>63) - 1
-	memTableLimit := 4
 	memTableSize := cache * 1024 * 1024 / 2 / memTableLimit
 	if memTableSize >= maxMemTableSize {
 		memTableSize = maxMemTableSize - 1
 	}
+	d := &PebbleV2{fn: file}
 
 	opt := &pebblev2.Options{
 		// Pebble has a single combined cache area and the write
 		// buffers are taken from this too. Assign all available
 		// memory allowance for cache.
 		Cache:        pebblev2.NewCache(int64(cache * 1024 * 1024)),
-		MaxOpenFiles: handles,
+		MaxOpenFiles: opts.Handles,
 
 		// The size of memory table(as well as the write buffer).
 		// Note, there may have more than two memory tables in the system.
@@ -45,18 +122,11 @@ func New(file string, cache int, handles int) (*PebbleV2, error) {
 			return 2, runtime.NumCPU()
 		},
 
-		// Per-level options. Options for at least one level must be specified. The
-		// options for the last level are used for all subsequent levels.
-		Levels: [7]pebblev2.LevelOptions{
-			{BlockSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 4 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 8 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 16 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 32 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 64 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{BlockSize: 128 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-		},
 		ReadOnly: false,
+		EventListener: &pebblev2.EventListener{
+			WriteStallBegin: d.onWriteStallBegin,
+			WriteStallEnd:   d.onWriteStallEnd,
+		},
 
 		// Pebble is configured to use asynchronous write mode, meaning write operations
 		// return as soon as the data is cached in memory, without waiting for the WAL
@@ -76,21 +146,41 @@ func New(file string, cache int, handles int) (*PebbleV2, error) {
 		// The default value in Pebble is 4, which is a bit too large to have
 		// the compaction debt as around 10GB. By reducing it to 2, the compaction
 		// debt will be less than 1GB, but with more frequent compactions scheduled.
-		L0CompactionThreshold: 2,
+		L0CompactionThreshold: opts.L0CompactionThreshold,
+	}
+	// Per-level options. Options for at least one level must be specified. The
+	// options for the last level are used for all subsequent levels.
+	for i := range opt.Levels {
+		opt.Levels[i].BlockSize = opts.BlockSize << i
+		if opts.BloomBitsPerKey > 0 {
+			opt.Levels[i].FilterPolicy = bloom.FilterPolicy(opts.BloomBitsPerKey)
+		}
 	}
 
 	db, err := pebblev2.Open(file, opt)
 	if err != nil {
 		return nil, err
 	}
-	return &PebbleV2{
-		db:           db,
-		writeOptions: pebblev2.NoSync,
-	}, nil
+	d.db = db
+	d.writeOptions = pebblev2.NoSync
+	if opts.Sync {
+		d.writeOptions = pebblev2.Sync
+	}
+	if opts.MetricsInterval > 0 {
+		d.done = make(chan struct{})
+		d.meterWg.Add(1)
+		go d.meter(opts.MetricsInterval)
+	}
+	return d, nil
 }
 
 // Has retrieves if a key is present in the key-value store.
 func (d *PebbleV2) Has(key []byte) (bool, error) {
+	d.quitLock.RLock()
+	defer d.quitLock.RUnlock()
+	if d.closed {
+		return false, pebblev2.ErrClosed
+	}
 	_, closer, err := d.db.Get(key)
 	if err == pebblev2.ErrNotFound {
 		return false, nil
@@ -105,6 +195,11 @@ func (d *PebbleV2) Has(key []byte) (bool, error) {
 
 // Get retrieves the given key if it's present in the key-value store.
 func (d *PebbleV2) Get(key []byte) ([]byte, error) {
+	d.quitLock.RLock()
+	defer d.quitLock.RUnlock()
+	if d.closed {
+		return nil, pebblev2.ErrClosed
+	}
 	dat, closer, err := d.db.Get(key)
 	if err != nil {
 		return nil, err
@@ -119,16 +214,300 @@ func (d *PebbleV2) Get(key []byte) ([]byte, error) {
 
 // Put inserts the given value into the key-value store.
 func (d *PebbleV2) Put(key []byte, value []byte) error {
+	d.quitLock.RLock()
+	defer d.quitLock.RUnlock()
+	if d.closed {
+		return pebblev2.ErrClosed
+	}
 	return d.db.Set(key, value, d.writeOptions)
 }
 
 // Delete removes the key from the key-value store.
 func (d *PebbleV2) Delete(key []byte) error {
+	d.quitLock.RLock()
+	defer d.quitLock.RUnlock()
+	if d.closed {
+		return pebblev2.ErrClosed
+	}
 	return d.db.Delete(key, d.writeOptions)
 }
 
-// Close stops the metrics collection, flushes any pending data to disk and closes
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end).
+func (d *PebbleV2) DeleteRange(start, end []byte) error {
+	d.quitLock.RLock()
+	defer d.quitLock.RUnlock()
+	if d.closed {
+		return pebblev2.ErrClosed
+	}
+	// There is no special flag to represent the end of key range
+	// in pebble(nil in leveldb). Use an ugly hack to construct a
+	// large key to represent it.
+	if end == nil {
+		end = ethdb.MaximumKey
+	}
+	return d.db.DeleteRange(start, end, d.writeOptions)
+}
+
+// NewBatch creates a write-only key-value store that buffers changes to its host
+// database until a final write is called.
+func (d *PebbleV2) NewBatch() ethdb.Batch {
+	return &batch{
+		b:  d.db.NewBatch(),
+		db: d,
+	}
+}
+
+// NewBatchWithSize creates a write-only database batch with pre-allocated buffer.
+func (d *PebbleV2) NewBatchWithSize(size int) ethdb.Batch {
+	return &batch{
+		b:  d.db.NewBatchWithSize(size),
+		db: d,
+	}
+}
+
+// upperBound returns the upper bound for the given prefix
+func upperBound(prefix []byte) (limit []byte) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		c := prefix[i]
+		if c == 0xff {
+			continue
+		}
+		limit = make([]byte, i+1)
+		copy(limit, prefix)
+		limit[i] = c + 1
+		break
+	}
+	return limit
+}
+
+// Stat returns the internal metrics of Pebble in a text format. It's a developer
+// method to read everything there is to read, independent of Pebble version.
+func (d *PebbleV2) Stat() (string, error) {
+	return d.db.Metrics().String(), nil
+}
+
+// Compact flattens the underlying data store for the given key range. In essence,
+// deleted and overwritten versions are discarded, and the data is rearranged to
+// reduce the cost of operations needed to access them.
+//
+// A nil start is treated as a key before all keys in the data store; a nil limit
+// is treated as a key after all keys in the data store. If both is nil then it
+// will compact entire data store.
+func (d *PebbleV2) Compact(start []byte, limit []byte) error {
+	// There is no special flag to represent the end of key range
+	// in pebble(nil in leveldb). Use an ugly hack to construct a
+	// large key to represent it.
+	if limit == nil {
+		limit = ethdb.MaximumKey
+	}
+	return d.db.Compact(context.Background(), start, limit, true) // Parallelization is preferred
+}
+
+// Path returns the path to the database directory.
+func (d *PebbleV2) Path() string {
+	return d.fn
+}
+
+// SyncKeyValue flushes all pending writes in the write-ahead-log to disk,
+// ensuring data durability up to that point.
+func (d *PebbleV2) SyncKeyValue() error {
+	// The entry (value=nil) is not written to the database; it is only
+	// added to the WAL. Writing this special log entry in sync mode
+	// automatically flushes all previous writes, ensuring database
+	// durability up to this point.
+	b := d.db.NewBatch()
+	b.LogData(nil, nil)
+	return d.db.Apply(b, pebblev2.Sync)
+}
+
+// Close stops the metrics logger, flushes any pending data to disk and closes
 // all io accesses to the underlying key-value store.
 func (d *PebbleV2) Close() error {
+	d.quitLock.Lock()
+	defer d.quitLock.Unlock()
+	// Allow double closing, simplifies things
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	if d.done != nil {
+		close(d.done)
+		d.meterWg.Wait()
+	}
 	return d.db.Close()
 }
+
+// batch is a write-only batch that commits changes to its host database
+// when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	b    *pebblev2.Batch
+	db   *PebbleV2
+	size int
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	if err := b.b.Set(key, value, nil); err != nil {
+		return err
+	}
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	if err := b.b.Delete(key, nil); err != nil {
+		return err
+	}
+	b.size += len(key)
+	return nil
+}
+
+// DeleteRange removes all keys in the range [start, end) from the batch for
+// later committing, inclusive on start, exclusive on end.
+func (b *batch) DeleteRange(start, end []byte) error {
+	// There is no special flag to represent the end of key range
+	// in pebble(nil in leveldb). Use an ugly hack to construct a
+	// large key to represent it.
+	if end == nil {
+		end = ethdb.MaximumKey
+	}
+	if err := b.b.DeleteRange(start, end, nil); err != nil {
+		return err
+	}
+	// Approximate size impact - just the keys
+	b.size += len(start) + len(end)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to disk.
+func (b *batch) Write() error {
+	b.db.quitLock.RLock()
+	defer b.db.quitLock.RUnlock()
+	if b.db.closed {
+		return pebblev2.ErrClosed
+	}
+	return b.b.Commit(b.db.writeOptions)
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.b.Reset()
+	b.size = 0
+}
+
+// Replay replays the batch contents.
+func (b *batch) Replay(w ethdb.KeyValueWriter) error {
+	reader := b.b.Reader()
+	for {
+		kind, k, v, ok, err := reader.Next()
+		if !ok || err != nil {
+			return err
+		}
+		// The (k,v) slices might be overwritten if the batch is reset/reused,
+		// and the receiver should copy them if they are to be retained long-term.
+		if kind == pebblev2.InternalKeyKindSet {
+			if err = w.Put(k, v); err != nil {
+				return err
+			}
+		} else if kind == pebblev2.InternalKeyKindDelete {
+			if err = w.Delete(k); err != nil {
+				return err
+			}
+		} else if kind == pebblev2.InternalKeyKindRangeDelete {
+			// For range deletion, k is the start key and v is the end key
+			if rangeDeleter, ok := w.(ethdb.KeyValueRangeDeleter); ok {
+				if err = rangeDeleter.DeleteRange(k, v); err != nil {
+					return err
+				}
+			} else {
+				return errors.New("ethdb.KeyValueWriter does not implement DeleteRange")
+			}
+		} else {
+			return fmt.Errorf("unhandled operation, keytype: %v", kind)
+		}
+	}
+}
+
+// pebbleIterator is a wrapper of underlying iterator in storage engine.
+// The purpose of this structure is to implement the missing APIs.
+//
+// The pebble iterator is not thread-safe.
+type pebbleIterator struct {
+	iter     *pebblev2.Iterator
+	err      error // failure to create the iterator
+	moved    bool
+	released bool
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset
+// of database content with a particular key prefix, starting at a particular
+// initial key (or after, if it does not exist).
+func (d *PebbleV2) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	iter, err := d.db.NewIter(&pebblev2.IterOptions{
+		LowerBound: append(prefix, start...),
+		UpperBound: upperBound(prefix),
+	})
+	if err != nil {
+		return &pebbleIterator{err: err, released: true}
+	}
+	iter.First()
+	return &pebbleIterator{iter: iter, moved: true, released: false}
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (iter *pebbleIterator) Next() bool {
+	if iter.iter == nil {
+		return false
+	}
+	if iter.moved {
+		iter.moved = false
+		return iter.iter.Valid()
+	}
+	return iter.iter.Next()
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (iter *pebbleIterator) Error() error {
+	if iter.iter == nil {
+		return iter.err
+	}
+	return iter.iter.Error()
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (iter *pebbleIterator) Key() []byte {
+	if iter.iter == nil {
+		return nil
+	}
+	return iter.iter.Key()
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (iter *pebbleIterator) Value() []byte {
+	if iter.iter == nil {
+		return nil
+	}
+	return iter.iter.Value()
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (iter *pebbleIterator) Release() {
+	if !iter.released {
+		iter.iter.Close()
+		iter.released = true
+	}
+}
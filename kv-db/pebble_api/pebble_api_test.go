@@ -0,0 +1,18 @@
+package pebble_api
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/dbtest"
+)
+
+func TestPebbleDB(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ethdb.KeyValueStore {
+		db, err := New(t.TempDir(), 16, 16, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,186 @@
+package sharded_db
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// rangeOp marks a range deletion in batch.order, it went to every shard batch.
+const rangeOp = -1
+
+// batch splits the writes by shard into one batch per shard, created when the shard is first
+// written to. Write commits the shard batches concurrently, so a batch is atomic per shard
+// but not across shards.
+type batch struct {
+	store   *ShardedStore
+	size    int
+	batches []ethdb.Batch
+	ops     []int   // the writes queued in every shard batch, Write skips the shards without any
+	order   []int32 // the shard of every write, rangeOp for range deletions, for Replay
+}
+
+// NewBatch creates a write-only key-value store that buffers changes to its host
+// database until a final write is called.
+func (s *ShardedStore) NewBatch() ethdb.Batch {
+	return &batch{store: s, batches: make([]ethdb.Batch, len(s.shards)), ops: make([]int, len(s.shards))}
+}
+
+// NewBatchWithSize creates a write-only database batch with pre-allocated buffer.
+// The size is split evenly between the shards.
+func (s *ShardedStore) NewBatchWithSize(size int) ethdb.Batch {
+	b := s.NewBatch().(*batch)
+	for i, shard := range s.shards {
+		b.batches[i] = shard.NewBatchWithSize(size / len(s.shards))
+	}
+	return b
+}
+
+// shardBatch returns the batch of shard i for a write to queue.
+func (b *batch) shardBatch(i int) ethdb.Batch {
+	if b.batches[i] == nil {
+		b.batches[i] = b.store.shards[i].NewBatch()
+	}
+	b.ops[i]++
+	return b.batches[i]
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	i := b.store.ShardOf(key)
+	if err := b.shardBatch(i).Put(key, value); err != nil {
+		return err
+	}
+	b.order = append(b.order, int32(i))
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	i := b.store.ShardOf(key)
+	if err := b.shardBatch(i).Delete(key); err != nil {
+		return err
+	}
+	b.order = append(b.order, int32(i))
+	b.size += len(key)
+	return nil
+}
+
+// DeleteRange removes all keys in the range [start, end) from the batch for
+// later committing, inclusive on start, exclusive on end. The keys of the range
+// can be on any shard, so the deletion goes to all of them.
+func (b *batch) DeleteRange(start, end []byte) error {
+	for i := range b.batches {
+		if err := b.shardBatch(i).DeleteRange(start, end); err != nil {
+			return err
+		}
+	}
+	b.order = append(b.order, rangeOp)
+	b.size += len(start) + len(end)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write commits the shard batches concurrently.
+func (b *batch) Write() error {
+	return b.store.parallel(func(i int, _ KeyValueStore) error {
+		// a deletion of an empty key or of the whole range has no size, but is a write
+		if b.ops[i] == 0 {
+			return nil
+		}
+		return b.batches[i].Write()
+	})
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	for i, sb := range b.batches {
+		if sb != nil {
+			sb.Reset()
+		}
+		b.ops[i] = 0
+	}
+	b.order = b.order[:0]
+	b.size = 0
+}
+
+// Replay replays the batch contents in the order they were added. The shard batches
+// are replayed into queues first and interleaved by order, replaying them one after
+// the other would let a later shard's range deletion remove an earlier shard's writes.
+func (b *batch) Replay(w ethdb.KeyValueWriter) error {
+	queues := make([]*recorder, len(b.batches))
+	for i, sb := range b.batches {
+		queues[i] = new(recorder)
+		if sb != nil {
+			if err := sb.Replay(queues[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, shard := range b.order {
+		var op recordedOp
+		if shard == rangeOp {
+			for _, q := range queues {
+				op = q.pop()
+			}
+		} else {
+			op = queues[shard].pop()
+		}
+		if err := op.apply(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type recordedOp struct {
+	key, value []byte
+	rangeEnd   []byte
+	delete     bool
+	isRange    bool
+}
+
+func (op recordedOp) apply(w ethdb.KeyValueWriter) error {
+	switch {
+	case op.isRange:
+		if d, ok := w.(ethdb.KeyValueRangeDeleter); ok {
+			return d.DeleteRange(op.key, op.rangeEnd)
+		}
+		return errNotSupported
+	case op.delete:
+		return w.Delete(op.key)
+	default:
+		return w.Put(op.key, op.value)
+	}
+}
+
+// recorder copies what a shard batch replays, the slices are only valid during Replay.
+type recorder struct {
+	ops []recordedOp
+}
+
+func (r *recorder) Put(key, value []byte) error {
+	r.ops = append(r.ops, recordedOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+	return nil
+}
+
+func (r *recorder) Delete(key []byte) error {
+	r.ops = append(r.ops, recordedOp{key: bytes.Clone(key), delete: true})
+	return nil
+}
+
+func (r *recorder) DeleteRange(start, end []byte) error {
+	r.ops = append(r.ops, recordedOp{key: bytes.Clone(start), rangeEnd: bytes.Clone(end), isRange: true})
+	return nil
+}
+
+func (r *recorder) pop() recordedOp {
+	op := r.ops[0]
+	r.ops = r.ops[1:]
+	return op
+}
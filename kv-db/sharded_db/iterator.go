@@ -0,0 +1,115 @@
+package sharded_db
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// iterator merges the iterators of the shards. Every key lives on exactly one shard,
+// so the merge never has to skip duplicates.
+type iterator struct {
+	iters   []ethdb.Iterator
+	heap    iterHeap // the started iterators that have a key, except cur
+	cur     ethdb.Iterator
+	started bool
+	err     error
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset
+// of database content with a particular key prefix, starting at a particular
+// initial key (or after, if it does not exist).
+func (s *ShardedStore) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	it := &iterator{iters: make([]ethdb.Iterator, len(s.shards))}
+	for i, shard := range s.shards {
+		it.iters[i] = shard.NewIterator(prefix, start)
+	}
+	return it
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (it *iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		for _, sub := range it.iters {
+			if !it.advance(sub) {
+				return false
+			}
+		}
+	} else if it.cur != nil && !it.advance(it.cur) {
+		it.cur = nil
+		return false
+	}
+	if len(it.heap) == 0 {
+		it.cur = nil
+		return false
+	}
+	it.cur = heap.Pop(&it.heap).(ethdb.Iterator)
+	return true
+}
+
+// advance moves sub to its next key and pushes it onto the heap unless it is exhausted.
+// It returns false if sub failed.
+func (it *iterator) advance(sub ethdb.Iterator) bool {
+	if sub.Next() {
+		heap.Push(&it.heap, sub)
+		return true
+	}
+	it.err = sub.Error()
+	return it.err == nil
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (it *iterator) Error() error {
+	return it.err
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (it *iterator) Key() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.Key()
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (it *iterator) Value() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.Value()
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (it *iterator) Release() {
+	for _, sub := range it.iters {
+		sub.Release()
+	}
+	it.heap = nil
+	it.cur = nil
+}
+
+// iterHeap orders the shard iterators by their current key.
+type iterHeap []ethdb.Iterator
+
+func (h iterHeap) Len() int           { return len(h) }
+func (h iterHeap) Less(i, j int) bool { return bytes.Compare(h[i].Key(), h[j].Key()) < 0 }
+func (h iterHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x any)        { *h = append(*h, x.(ethdb.Iterator)) }
+func (h *iterHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,208 @@
+package sharded_db
+
+/* A ShardedStore spreads the keys over N backends with consistent hashing: every shard owns
+vnodesPerShard points on a 64-bit ring and a key belongs to the shard of the first point at or
+after the hash of its bytes. The points of a shard only depend on its index, so the stores have to be
+reopened with the same backends in the same order, and growing from N to N+1 shards moves about 1/(N+1)
+of the keys instead of almost all of them like key % N.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// vnodesPerShard is the number of ring points of a shard, the key shares of the shards differ
+// by about 1/sqrt(vnodesPerShard).
+const vnodesPerShard = 256
+
+// KeyValueStore is what a ShardedStore needs from its backends. DeleteRange, Stat and Compact are
+// forwarded to the backends implementing them.
+type KeyValueStore interface {
+	ethdb.KeyValueReader
+	ethdb.KeyValueWriter
+	ethdb.KeyValueSyncer
+	ethdb.Batcher
+	ethdb.Iteratee
+	io.Closer
+}
+
+type ShardedStore struct {
+	shards []KeyValueStore
+	points []uint64 // sorted ring points
+	owners []int    // owners[i] is the shard of points[i]
+}
+
+var _ ethdb.KeyValueStore = (*ShardedStore)(nil)
+
+var errNotSupported = errors.New("not supported by the shard")
+
+// New creates a ShardedStore over shards, which it owns from now on and closes on Close.
+func New(shards []KeyValueStore) (*ShardedStore, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	type point struct {
+		hash  uint64
+		shard int
+	}
+	ring := make([]point, 0, len(shards)*vnodesPerShard)
+	for i := range shards {
+		for v := 0; v < vnodesPerShard; v++ {
+			ring = append(ring, point{hashKey(fmt.Appendf(nil, "shard-%d-%d", i, v)), i})
+		}
+	}
+	// ties are broken by the shard index so the ring doesn't depend on the sort
+	slices.SortFunc(ring, func(a, b point) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		return a.shard - b.shard
+	})
+	s := &ShardedStore{
+		shards: shards,
+		points: make([]uint64, len(ring)),
+		owners: make([]int, len(ring)),
+	}
+	for i, p := range ring {
+		s.points[i], s.owners[i] = p.hash, p.shard
+	}
+	return s, nil
+}
+
+// hashKey is 64-bit FNV-1a finished with the splitmix64 finalizer, FNV alone barely changes
+// the high bits for keys that only differ at the end.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// ShardOf returns the index of the shard owning key.
+func (s *ShardedStore) ShardOf(key []byte) int {
+	h := hashKey(key)
+	i, _ := slices.BinarySearch(s.points, h)
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.owners[i]
+}
+
+// Shards returns the backends in the order given to New.
+func (s *ShardedStore) Shards() []KeyValueStore {
+	return s.shards
+}
+
+func (s *ShardedStore) shard(key []byte) KeyValueStore {
+	return s.shards[s.ShardOf(key)]
+}
+
+// Has retrieves if a key is present in the key-value store.
+func (s *ShardedStore) Has(key []byte) (bool, error) {
+	return s.shard(key).Has(key)
+}
+
+// Get retrieves the given key if it's present in the key-value store.
+func (s *ShardedStore) Get(key []byte) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+// Put inserts the given value into the key-value store.
+func (s *ShardedStore) Put(key []byte, value []byte) error {
+	return s.shard(key).Put(key, value)
+}
+
+// Delete removes the key from the key-value store.
+func (s *ShardedStore) Delete(key []byte) error {
+	return s.shard(key).Delete(key)
+}
+
+// parallel runs fn for every shard concurrently and joins the errors, prefixed with the shard index.
+func (s *ShardedStore) parallel(fn func(i int, shard KeyValueStore) error) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, shard); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end) from every shard.
+func (s *ShardedStore) DeleteRange(start, end []byte) error {
+	return s.parallel(func(i int, shard KeyValueStore) error {
+		if d, ok := shard.(ethdb.KeyValueRangeDeleter); ok {
+			return d.DeleteRange(start, end)
+		}
+		return fmt.Errorf("DeleteRange: %w", errNotSupported)
+	})
+}
+
+// SyncKeyValue flushes all the shards to disk.
+func (s *ShardedStore) SyncKeyValue() error {
+	return s.parallel(func(i int, shard KeyValueStore) error {
+		return shard.SyncKeyValue()
+	})
+}
+
+// Compact flattens the underlying data store of every shard for the given key range.
+// Shards that can only compact everything, like simple_db, compact everything.
+func (s *ShardedStore) Compact(start []byte, limit []byte) error {
+	return s.parallel(func(i int, shard KeyValueStore) error {
+		switch c := shard.(type) {
+		case ethdb.Compacter:
+			return c.Compact(start, limit)
+		case interface{ Compact() error }:
+			return c.Compact()
+		}
+		return fmt.Errorf("Compact: %w", errNotSupported)
+	})
+}
+
+// Stat returns the statistics of the shards that have them, one section per shard.
+func (s *ShardedStore) Stat() (string, error) {
+	var b strings.Builder
+	for i, shard := range s.shards {
+		stater, ok := shard.(ethdb.KeyValueStater)
+		if !ok {
+			continue
+		}
+		stat, err := stater.Stat()
+		if err != nil {
+			return "", fmt.Errorf("shard %d: %w", i, err)
+		}
+		fmt.Fprintf(&b, "shard %d:\n%s\n", i, stat)
+	}
+	return b.String(), nil
+}
+
+// Close closes all the shards.
+func (s *ShardedStore) Close() error {
+	var errs []error
+	for i, shard := range s.shards {
+		if err := shard.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,200 @@
+package sharded_db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/dbtest"
+
+	"kv_db/simple_db"
+)
+
+func newStore(t *testing.T, dir string, n int) *ShardedStore {
+	t.Helper()
+	shards := make([]KeyValueStore, n)
+	for i := range shards {
+		db, err := simple_db.NewDatabase(filepath.Join(dir, fmt.Sprintf("shard%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards[i] = db
+	}
+	s, err := New(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestShardOfStable(t *testing.T) {
+	four := newStore(t, t.TempDir(), 4)
+	defer four.Close()
+	again := newStore(t, t.TempDir(), 4)
+	defer again.Close()
+	five := newStore(t, t.TempDir(), 5)
+	defer five.Close()
+
+	const keys = 100000
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		shard := four.ShardOf(key)
+		if again.ShardOf(key) != shard {
+			t.Fatalf("key %s: shard %d, %d in a store with the same shards", key, shard, again.ShardOf(key))
+		}
+		counts[shard]++
+		// growing only moves keys to the new shard
+		if grown := five.ShardOf(key); grown != shard {
+			if grown != 4 {
+				t.Fatalf("key %s moved from shard %d to %d", key, shard, grown)
+			}
+			moved++
+		}
+	}
+	// the shares differ by about 1/sqrt(vnodesPerShard), about 6%
+	for i, c := range counts {
+		if c < keys/4*3/4 || c > keys/4*5/4 {
+			t.Errorf("shard %d owns %d of %d keys", i, c, keys)
+		}
+	}
+	if moved < keys/5*3/4 || moved > keys/5*5/4 {
+		t.Errorf("growing to 5 shards moved %d of %d keys", moved, keys)
+	}
+}
+
+func TestIteratorAcrossShards(t *testing.T) {
+	s := newStore(t, t.TempDir(), 4)
+	defer s.Close()
+	kvs := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("%c%03d", 'a'+i%5, i)
+		if err := s.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[key] = "v" + key
+	}
+	shards := make(map[int]bool)
+	for k := range kvs {
+		shards[s.ShardOf([]byte(k))] = true
+	}
+	if len(shards) != 4 {
+		t.Fatalf("the keys are on %d shards", len(shards))
+	}
+	for _, c := range []struct{ prefix, start string }{
+		{"", ""}, {"b", ""}, {"b", "200"}, {"", "c"}, {"c", "999"}, {"e", "4"}, {"z", ""},
+	} {
+		var want []string
+		for k := range kvs {
+			if strings.HasPrefix(k, c.prefix) && k >= c.prefix+c.start {
+				want = append(want, k)
+			}
+		}
+		sort.Strings(want)
+		var got []string
+		it := s.NewIterator([]byte(c.prefix), []byte(c.start))
+		for it.Next() {
+			if string(it.Value()) != kvs[string(it.Key())] {
+				t.Fatalf("key %s: got %q, want %q", it.Key(), it.Value(), kvs[string(it.Key())])
+			}
+			got = append(got, string(it.Key()))
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		it.Release()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("prefix %q start %q: got %q, want %q", c.prefix, c.start, got, want)
+		}
+	}
+}
+
+// opLog records what a batch replays.
+type opLog []string
+
+func (l *opLog) Put(key, value []byte) error {
+	*l = append(*l, fmt.Sprintf("put %s=%s", key, value))
+	return nil
+}
+
+func (l *opLog) Delete(key []byte) error {
+	*l = append(*l, fmt.Sprintf("delete %s", key))
+	return nil
+}
+
+func (l *opLog) DeleteRange(start, end []byte) error {
+	*l = append(*l, fmt.Sprintf("deleterange %s-%s", start, end))
+	return nil
+}
+
+func TestBatchReplayOrder(t *testing.T) {
+	s := newStore(t, t.TempDir(), 4)
+	defer s.Close()
+	b := s.NewBatch()
+	var want opLog
+	for i := 0; i < 40; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i%10))
+		switch i % 4 {
+		case 0, 1:
+			value := []byte(fmt.Sprintf("v%d", i))
+			b.Put(key, value)
+			want.Put(key, value)
+		case 2:
+			b.Delete(key)
+			want.Delete(key)
+		case 3:
+			end := []byte(fmt.Sprintf("key%02d", i%10+3))
+			b.DeleteRange(key, end)
+			want.DeleteRange(key, end)
+		}
+	}
+	var got opLog
+	if err := b.Replay(&got); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("replayed\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Deletions without a size, of an empty key or of the whole key space, are written too.
+func TestBatchWriteSizelessDeletes(t *testing.T) {
+	s := newStore(t, t.TempDir(), 4)
+	defer s.Close()
+	for _, key := range []string{"", "a", "b", "c"} {
+		if err := s.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := s.NewBatch()
+	b.Delete([]byte{})
+	if err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := s.Has([]byte{}); has {
+		t.Fatal("the empty key survived its deletion")
+	}
+	b.Reset()
+	b.DeleteRange(nil, nil)
+	if b.ValueSize() != 0 {
+		t.Fatalf("batch of %d bytes", b.ValueSize())
+	}
+	if err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if has, _ := s.Has([]byte(key)); has {
+			t.Fatalf("key %s survived DeleteRange(nil, nil)", key)
+		}
+	}
+}
+
+func TestDatabaseSuite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() ethdb.KeyValueStore {
+		return newStore(t, t.TempDir(), 4)
+	})
+}
@@ -0,0 +1,276 @@
+package simple_db
+
+/* A batch is written as one record with batchFlag set in keySize and the entries as its value,
+an entry is keySize(4) | valueSize(8) | key | value with the tombstone flag in keySize.
+The record checksum covers all entries, so a torn batch is dropped as a whole on open.
+DeleteRange is resolved to tombstones for the keys in the range when the batch is written.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/RaduBerinde/btreemap"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+const entryHeaderSize = 12
+
+type batchOp struct {
+	key      []byte
+	value    []byte
+	delete   bool
+	rangeEnd []byte // DeleteRange [key, rangeEnd), a nil rangeEnd is unbounded
+	isRange  bool
+}
+
+// batch is a write-only batch that commits changes to its host database
+// when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	db   *Database
+	ops  []batchOp
+	size int
+}
+
+// NewBatch creates a write-only key-value store that buffers changes to its host
+// database until a final write is called.
+func (db *Database) NewBatch() ethdb.Batch {
+	return &batch{db: db}
+}
+
+// NewBatchWithSize creates a write-only database batch, size is ignored as ops are buffered until Write.
+func (db *Database) NewBatchWithSize(size int) ethdb.Batch {
+	return db.NewBatch()
+}
+
+// DeleteRange deletes all keys in [start, end) atomically, a nil end deletes everything from start on.
+func (db *Database) DeleteRange(start, end []byte) error {
+	b := db.NewBatch()
+	if err := b.DeleteRange(start, end); err != nil {
+		return err
+	}
+	return b.Write()
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), delete: true})
+	b.size += len(key)
+	return nil
+}
+
+// DeleteRange removes all keys in the range [start, end) from the batch for
+// later committing, inclusive on start, exclusive on end.
+func (b *batch) DeleteRange(start, end []byte) error {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(start), rangeEnd: bytes.Clone(end), isRange: true})
+	b.size += len(start) + len(end)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to disk.
+func (b *batch) Write() error {
+	return b.db.writeBatch(b.ops)
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.ops = b.ops[:0]
+	b.size = 0
+}
+
+// Replay replays the batch contents.
+func (b *batch) Replay(w ethdb.KeyValueWriter) error {
+	for _, op := range b.ops {
+		switch {
+		case op.isRange:
+			rangeDeleter, ok := w.(ethdb.KeyValueRangeDeleter)
+			if !ok {
+				return errors.New("ethdb.KeyValueWriter does not implement DeleteRange")
+			}
+			if err := rangeDeleter.DeleteRange(op.key, op.rangeEnd); err != nil {
+				return err
+			}
+		case op.delete:
+			if err := w.Delete(op.key); err != nil {
+				return err
+			}
+		default:
+			if err := w.Put(op.key, op.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
+
+// keysInRange returns the keys in [start, end) after the batch entries written so far, db.lock must be held.
+func (db *Database) keysInRange(start, end []byte, pending map[string]bool) [][]byte {
+	stop := btreemap.Max[string]()
+	if end != nil {
+		stop = btreemap.LT(string(end))
+	}
+	var keys [][]byte
+	for key := range db.kvEntries.Ascend(btreemap.GE(string(start)), stop) {
+		if _, ok := pending[key]; !ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	for key, live := range pending {
+		if live && inRange([]byte(key), start, end) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+func (db *Database) writeBatch(ops []batchOp) error {
+	size := int64(headerSize)
+	for _, op := range ops {
+		if len(op.key) > maxKeySize {
+			return fmt.Errorf("key of %d bytes too large", len(op.key))
+		}
+		size += entryHeaderSize + int64(len(op.key)+len(op.value))
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return errClosed
+	}
+	if db.hashed != nil {
+		keys := make([][]byte, len(ops))
+		for i, op := range ops {
+			if op.isRange {
+				return fmt.Errorf("DeleteRange %w", errUnordered)
+			}
+			keys[i] = op.key
+		}
+		if err := checkHashed(size, keys...); err != nil {
+			return err
+		}
+	}
+
+	type update struct {
+		key       []byte
+		valueSize int
+		valueOff  int64
+		tombstone bool
+	}
+	var updates []update
+	// liveness of the keys the batch wrote so far, DeleteRange has to see them
+	pending := make(map[string]bool)
+	start := len(db.appendBuf)
+	base := db.active.size - int64(start) // segment offset of appendBuf[0]
+	db.appendBuf = append(db.appendBuf, make([]byte, headerSize)...)
+	add := func(key, value []byte, tombstone bool) {
+		keySize := uint32(len(key))
+		if tombstone {
+			keySize |= tombstoneFlag
+		}
+		db.appendBuf = binary.BigEndian.AppendUint32(db.appendBuf, keySize)
+		db.appendBuf = binary.BigEndian.AppendUint64(db.appendBuf, uint64(len(value)))
+		db.appendBuf = append(db.appendBuf, key...)
+		updates = append(updates, update{key, len(value), base + int64(len(db.appendBuf)), tombstone})
+		db.appendBuf = append(db.appendBuf, value...)
+		pending[string(key)] = !tombstone
+	}
+	for _, op := range ops {
+		switch {
+		case op.isRange:
+			for _, key := range db.keysInRange(op.key, op.rangeEnd, pending) {
+				add(key, nil, true)
+			}
+		case op.delete:
+			add(op.key, nil, true)
+		default:
+			add(op.key, op.value, false)
+		}
+	}
+	if len(updates) == 0 {
+		db.appendBuf = db.appendBuf[:start]
+		return nil
+	}
+
+	record := db.appendBuf[start:]
+	binary.BigEndian.PutUint32(record[4:], batchFlag)
+	binary.BigEndian.PutUint64(record[8:], uint64(len(record)-headerSize))
+	binary.BigEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	db.active.size += int64(len(record))
+
+	// the record is written, so all of its entries go to the hint even if one can't be indexed
+	var indexErr error
+	for _, u := range updates {
+		var err error
+		if u.tombstone {
+			err = db.unindex(string(u.key))
+		} else {
+			err = db.index(string(u.key), valueEntry{segment: db.active.id, valueOff: u.valueOff, valueSize: u.valueSize})
+		}
+		if err != nil && indexErr == nil {
+			indexErr = err
+		}
+		db.hintBuf = appendHint(db.hintBuf, u.key, u.valueSize, u.valueOff, u.tombstone)
+	}
+	err := db.appended()
+	db.maybeCompact()
+	if indexErr != nil {
+		return indexErr
+	}
+	return err
+}
+
+// walkBatch calls fn for every entry of the batch record at off and stops at its first error,
+// with fn nil it only validates them.
+func walkBatch(off int64, entries []byte, fn func(key []byte, valueSize int, valueOff int64, tombstone bool) error) error {
+	pos := 0
+	for pos < len(entries) {
+		if len(entries)-pos < entryHeaderSize {
+			return errors.New("malformed batch")
+		}
+		keySize := binary.BigEndian.Uint32(entries[pos:])
+		valueSize := binary.BigEndian.Uint64(entries[pos+4:])
+		tombstone := keySize&tombstoneFlag != 0
+		keySize &^= tombstoneFlag
+		rest := uint64(len(entries) - pos - entryHeaderSize)
+		if uint64(keySize) > rest || valueSize > rest-uint64(keySize) {
+			return errors.New("malformed batch")
+		}
+		key := entries[pos+entryHeaderSize : pos+entryHeaderSize+int(keySize)]
+		pos += entryHeaderSize + int(keySize)
+		if fn != nil {
+			if err := fn(key, int(valueSize), off+headerSize+int64(pos), tombstone); err != nil {
+				return err
+			}
+		}
+		pos += int(valueSize)
+	}
+	return nil
+}
+
+// replayBatch indexes the entries of the batch record at off in seg, which walkBatch validated.
+func (db *Database) replayBatch(seg *segment, off int64, entries []byte, hint *[]byte) error {
+	return walkBatch(off, entries, func(key []byte, valueSize int, valueOff int64, tombstone bool) error {
+		if hint != nil {
+			*hint = appendHint(*hint, key, valueSize, valueOff, tombstone)
+		}
+		return db.apply(seg, key, valueSize, valueOff, tombstone)
+	})
+}
@@ -0,0 +1,100 @@
+package simple_db
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// opRecorder records the ops replayed into it.
+type opRecorder []string
+
+func (r *opRecorder) Put(key, value []byte) error {
+	*r = append(*r, fmt.Sprintf("put %s=%s", key, value))
+	return nil
+}
+
+func (r *opRecorder) Delete(key []byte) error {
+	*r = append(*r, fmt.Sprintf("delete %s", key))
+	return nil
+}
+
+func (r *opRecorder) DeleteRange(start, end []byte) error {
+	*r = append(*r, fmt.Sprintf("deleteRange %s-%s", start, end))
+	return nil
+}
+
+func TestBatchDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := make(map[string]string)
+	for i := 1; i <= 9; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[key] = value
+	}
+
+	// the range deletions cover stored keys and keys the batch wrote before them
+	b := db.NewBatch()
+	b.Put([]byte("key5"), []byte("batched"))
+	b.Put([]byte("key55"), []byte("batched"))
+	b.Delete([]byte("key7"))
+	b.DeleteRange([]byte("key3"), []byte("key6"))
+	b.Put([]byte("key4"), []byte("again"))
+	b.Put([]byte("key85"), []byte("batched"))
+	b.DeleteRange([]byte("key8"), nil)
+	b.Put([]byte("key9"), []byte("again"))
+	if err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"key1": "value1", "key2": "value2", "key4": "again", "key6": "value6", "key9": "again"}
+	checkState(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkState(t, db, want)
+
+	var ops opRecorder
+	if err := b.Replay(&ops); err != nil {
+		t.Fatal(err)
+	}
+	wantOps := []string{
+		"put key5=batched",
+		"put key55=batched",
+		"delete key7",
+		"deleteRange key3-key6",
+		"put key4=again",
+		"put key85=batched",
+		"deleteRange key8-",
+		"put key9=again",
+	}
+	if !slices.Equal(ops, wantOps) {
+		t.Fatalf("replayed %q, want %q", ops, wantOps)
+	}
+	// replaying into a database with the same contents ends in the same state
+	other, err := NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for k, v := range kvs {
+		if err := other.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Replay(other); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, other, want)
+}
@@ -0,0 +1,140 @@
+package simple_db
+
+/* The value cache keeps the values Get read from the segment files in a size-bounded LRU. It is keyed by where the
+value is, segment and offset, instead of by key: records are never rewritten in place and segment ids are not reused,
+so a Put, Delete or compaction points the index somewhere else and never has to invalidate the cache, the stale
+entries age out. The cache is split into shards by location so concurrent Gets rarely share a lock.
+Iterators don't use the cache, a scan would evict the working set of Get.
+*/
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	cacheShards = 16 // shard picks them by the top 4 bits of a hash
+	// cacheEntryOverhead approximates the memory of an entry besides its value: the list element, the map entry and the slice header
+	cacheEntryOverhead = 96
+)
+
+type cacheKey struct {
+	segment  uint32
+	valueOff int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value []byte
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[cacheKey]*list.Element
+	lru      list.List // most recently used first
+}
+
+type valueCache struct {
+	shards [cacheShards]cacheShard
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := new(valueCache)
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / cacheShards
+		c.shards[i].entries = make(map[cacheKey]*list.Element)
+	}
+	return c
+}
+
+func (c *valueCache) shard(key cacheKey) *cacheShard {
+	// Fibonacci hashing, the top 4 bits pick one of the 16 shards
+	h := (uint64(key.valueOff) ^ uint64(key.segment)<<40) * 0x9e3779b97f4a7c15
+	return &c.shards[h>>60]
+}
+
+// get returns the cached value, which the caller must not modify.
+func (c *valueCache) get(key cacheKey) ([]byte, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	s.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// add caches value, which the caller must not modify afterwards, evicting the least recently used values.
+func (c *valueCache) add(key cacheKey, value []byte) {
+	charge := int64(len(value)) + cacheEntryOverhead
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if charge > s.capacity {
+		return
+	}
+	if _, ok := s.entries[key]; ok {
+		// another Get read it meanwhile, values at a location never change
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, value: value})
+	s.size += charge
+	for s.size > s.capacity {
+		oldest := s.lru.Back()
+		e := oldest.Value.(*cacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.entries, e.key)
+		s.size -= int64(len(e.value)) + cacheEntryOverhead
+	}
+}
+
+// CacheStats are the statistics of the value cache.
+type CacheStats struct {
+	Capacity int64
+	Size     int64 // including cacheEntryOverhead per entry
+	Entries  int
+	Hits     int64
+	Misses   int64
+}
+
+// HitRate is the fraction of the lookups that hit, between 0 and 1.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s CacheStats) String() string {
+	const mib = 1024 * 1024
+	return fmt.Sprintf("value cache %.1f/%.1fMiB, %d entries, %d hits, %d misses, hit rate %.1f%%",
+		float64(s.Size)/mib, float64(s.Capacity)/mib, s.Entries, s.Hits, s.Misses, s.HitRate()*100)
+}
+
+// CacheStats returns the statistics of the value cache, zero if Options.CacheSize is 0.
+func (db *Database) CacheStats() CacheStats {
+	c := db.cache
+	if c == nil {
+		return CacheStats{}
+	}
+	stats := CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Capacity += s.capacity
+		stats.Size += s.size
+		stats.Entries += len(s.entries)
+		s.mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,126 @@
+package simple_db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// keysInShard returns n cache keys that fall into the same shard.
+func keysInShard(c *valueCache, n int) []cacheKey {
+	var keys []cacheKey
+	shard := c.shard(cacheKey{1, 0})
+	for off := int64(0); len(keys) < n; off++ {
+		if key := (cacheKey{1, off}); c.shard(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestCacheEviction(t *testing.T) {
+	const valueSize = 100
+	charge := int64(valueSize + cacheEntryOverhead)
+	// every shard holds 4 values
+	c := newValueCache(4 * charge * cacheShards)
+	keys := keysInShard(c, 6)
+	value := bytes.Repeat([]byte{'v'}, valueSize)
+	for _, key := range keys[:4] {
+		c.add(key, value)
+	}
+	// keys[0] becomes the most recently used, so keys[1] and keys[2] are evicted
+	if _, ok := c.get(keys[0]); !ok {
+		t.Fatal("cached value missing before the shard is full")
+	}
+	c.add(keys[4], value)
+	c.add(keys[5], value)
+	for i, want := range []bool{true, false, false, true, true, true} {
+		if _, ok := c.get(keys[i]); ok != want {
+			t.Errorf("key %d cached: %v, want %v", i, ok, want)
+		}
+	}
+	s := c.shard(keys[0])
+	if s.size != 4*charge || len(s.entries) != 4 || s.lru.Len() != 4 {
+		t.Fatalf("shard of %d bytes, %d entries, %d in the LRU list, want %d bytes and 4 entries", s.size, len(s.entries), s.lru.Len(), 4*charge)
+	}
+	// a value larger than a shard isn't cached and evicts nothing
+	c.add(keys[1], make([]byte, 4*charge))
+	if _, ok := c.get(keys[1]); ok {
+		t.Fatal("value larger than the shard was cached")
+	}
+	if len(s.entries) != 4 {
+		t.Fatalf("%d entries after adding a value larger than the shard", len(s.entries))
+	}
+}
+
+func TestCacheFollowsWrites(t *testing.T) {
+	opts := DefaultOptions
+	opts.CacheSize = 1 << 20
+	db, err := NewDatabaseWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// put writes and Syncs key so Get reads it from the segment file, not from appendBuf
+	put := func(key, value string) {
+		t.Helper()
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key, want string) {
+		t.Helper()
+		got, err := db.Get([]byte(key))
+		if err != nil || string(got) != want {
+			t.Fatalf("key %s: got %q %v, want %q", key, got, err, want)
+		}
+	}
+	stats := func(hits, misses int64) {
+		t.Helper()
+		if s := db.CacheStats(); s.Hits != hits || s.Misses != misses {
+			t.Fatalf("%d hits and %d misses, want %d and %d", s.Hits, s.Misses, hits, misses)
+		}
+	}
+
+	put("a", "old")
+	get("a", "old")
+	stats(0, 1)
+	get("a", "old")
+	get("a", "old")
+	stats(2, 1)
+	// the overwrite points the index to a new location, the cached old value is never read again
+	put("a", "new")
+	get("a", "new")
+	stats(2, 2)
+	get("a", "new")
+	stats(3, 2)
+	if err := db.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("a")); err == nil {
+		t.Fatal("deleted key is served from the cache")
+	}
+	// a missing key doesn't reach the cache
+	stats(3, 2)
+	// modifying a returned value doesn't change the cached one
+	put("b", "value")
+	got, _ := db.Get([]byte("b"))
+	copy(got, "xxxxx")
+	get("b", "value")
+	stats(4, 3)
+
+	s := db.CacheStats()
+	if s.Entries != 3 || s.Capacity != opts.CacheSize {
+		t.Fatalf("%d entries in a cache of %d bytes", s.Entries, s.Capacity)
+	}
+	if rate := s.HitRate(); rate != 4.0/7 {
+		t.Fatalf("hit rate %v, want %v", rate, 4.0/7)
+	}
+	if want := fmt.Sprintf("%d hits, %d misses", s.Hits, s.Misses); !strings.Contains(s.String(), want) {
+		t.Fatalf("%q doesn't report %q", s.String(), want)
+	}
+}
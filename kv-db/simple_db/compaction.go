@@ -0,0 +1,403 @@
+package simple_db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/RaduBerinde/btreemap"
+)
+
+/* Compaction rewrites the live records of all sealed segments into new segments and deletes the old ones.
+Stale versions and tombstones are dropped, a tombstone is only needed while an older record of its key exists.
+
+Gets and Puts continue meanwhile, they only touch the active segment. The outputs take ids that are reserved
+between the inputs and the active segment, so replay order stays right at every step:
+- an output is written to a .tmp file and renamed once complete, outputs and inputs hold the same live values
+- the inputs are deleted oldest first, so a tombstone never outlives the records it deletes
+
+An input that an open iterator still reads is deleted once the iterator is released, along with all inputs after it.
+*/
+
+// maybeCompact starts a background compaction once the garbage ratio is reached, db.lock must be held.
+func (db *Database) maybeCompact() {
+	if db.opts.CompactionRatio <= 0 {
+		return
+	}
+	size, live := int64(0), int64(0)
+	for _, seg := range db.segments {
+		if seg != db.active {
+			size += seg.size
+			live += seg.live
+		}
+	}
+	if size < db.opts.CompactionMinSize || float64(size-live) < db.opts.CompactionRatio*float64(size) {
+		return
+	}
+	if !db.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer db.compacting.Store(false)
+		if err := db.Compact(); err != nil && !errors.Is(err, errClosed) {
+			log.Printf("simple_db: compaction of %s failed: %v", db.path, err)
+		}
+	}()
+}
+
+// Compact seals the active segment and rewrites all segments with only the live records.
+func (db *Database) Compact() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return errClosed
+	}
+	inputs := make(map[uint32]*segment, len(db.segments))
+	var inputIDs []uint32
+	for id, seg := range db.segments {
+		inputs[id] = seg
+		inputIDs = append(inputIDs, id)
+	}
+	sort.Slice(inputIDs, func(i, j int) bool { return inputIDs[i] < inputIDs[j] })
+	// live data never needs more segments than it is spread over now
+	firstOutput := db.nextID
+	db.nextID += uint32(len(inputs))
+	if err := db.rollover(); err != nil {
+		db.lock.Unlock()
+		return err
+	}
+	if db.hashed != nil {
+		db.compactPrior = make(map[string]priorEntry)
+		db.lock.Unlock()
+		return db.compactHashed(inputs, inputIDs, firstOutput)
+	}
+	snapshot := db.kvEntries.Clone()
+	db.lock.Unlock()
+
+	// only compaction closes sealed segments and Close waits for compactMu, so the inputs stay open
+	outputs, compacted, err := db.writeOutputs(snapshot, inputs, firstOutput, len(inputs))
+	if err != nil {
+		for _, seg := range outputs {
+			seg.f.Close()
+			os.Remove(segmentPath(db.path, seg.id))
+			os.Remove(hintPath(db.path, seg.id))
+		}
+		return err
+	}
+
+	db.lock.Lock()
+	db.fileLock.Lock()
+	for _, seg := range outputs {
+		db.segments[seg.id] = seg
+	}
+	// entries of the inputs are unchanged since the snapshot, Puts and Deletes went to the new active segment
+	for key := range snapshot.Ascend(btreemap.Min[string](), btreemap.Max[string]()) {
+		if _, e, ok := db.kvEntries.Get(key); ok {
+			if _, ok := inputs[e.segment]; ok {
+				// the B-tree index reads no keys, index doesn't fail
+				db.index(key, compacted[key])
+			}
+		}
+	}
+	for _, id := range inputIDs {
+		delete(db.segments, id)
+		db.obsolete = append(db.obsolete, inputs[id])
+	}
+	db.fileLock.Unlock()
+	defer db.lock.Unlock()
+	return db.removeObsolete()
+}
+
+// priorEntry is the entry of a key when a hashed compaction started, ok is false if the key didn't exist.
+type priorEntry struct {
+	entry valueEntry
+	ok    bool
+}
+
+// replaced records the entry key had before its first change during a hashed compaction, db.lock must be held.
+func (db *Database) replaced(key string, old valueEntry, ok bool) {
+	if db.compactPrior == nil {
+		return
+	}
+	if _, seen := db.compactPrior[key]; !seen {
+		db.compactPrior[key] = priorEntry{old, ok}
+	}
+}
+
+// compactHashed is Compact with the hashed index, which can't be cloned like the B-tree: it scans the inputs
+// and copies the records that were live when it started, the ones the index pointed to unless db.compactPrior
+// has the entry from before a later change. Each output is indexed as soon as it is complete, keys changed meanwhile
+// keep pointing to their new records. The keys moved to the output being written are kept in memory meanwhile.
+func (db *Database) compactHashed(inputs map[uint32]*segment, inputIDs []uint32, firstID uint32) error {
+	type move struct {
+		key      string
+		from, to valueEntry
+	}
+	var moves []move
+	o := &outputWriter{db: db, firstID: firstID, n: len(inputs)}
+	o.finished = func(out *segment) {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+		db.segments[out.id] = out
+		for _, m := range moves {
+			if i, ok := db.hashed.findEntry(m.key, m.from); ok {
+				db.hashed.slots[i].segment, db.hashed.slots[i].valueOff = m.to.segment, uint32(m.to.valueOff)
+				size := recordSize(len(m.key), m.to.valueSize)
+				db.segments[m.from.segment].live -= size
+				out.live += size
+			}
+		}
+		moves = moves[:0]
+	}
+	live := func(key []byte, e valueEntry) bool {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+		if prior, ok := db.compactPrior[string(key)]; ok {
+			return prior.ok && prior.entry == e
+		}
+		_, ok := db.hashed.findEntry(string(key), e)
+		return ok
+	}
+
+	var err error
+	for _, id := range inputIDs {
+		err = scanSegment(inputs[id], func(key, value []byte, e valueEntry) error {
+			if !live(key, e) {
+				return nil
+			}
+			to, err := o.add(key, value)
+			if err != nil {
+				return err
+			}
+			if to.valueOff+int64(to.valueSize) > math.MaxUint32 {
+				o.abort()
+				return fmt.Errorf("compacted segment %d too large for the hashed index", to.segment)
+			}
+			moves = append(moves, move{string(key), e, to})
+			return nil
+		})
+		if err != nil {
+			o.abort()
+			break
+		}
+	}
+	if err == nil {
+		err = o.close()
+	}
+	if err == nil {
+		err = syncDir(db.path)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.compactPrior = nil
+	if err != nil {
+		// the outputs that are indexed stay, the next compaction drops their copies in the inputs
+		return err
+	}
+	db.fileLock.Lock()
+	for _, id := range inputIDs {
+		delete(db.segments, id)
+		db.obsolete = append(db.obsolete, inputs[id])
+	}
+	db.fileLock.Unlock()
+	return db.removeObsolete()
+}
+
+// scanSegment calls fn with the records of seg that aren't tombstones, the ones of batches included.
+// The key and value are only valid during the call.
+func scanSegment(seg *segment, fn func(key, value []byte, e valueEntry) error) error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(seg.f, 0, seg.size), 1024*1024)
+	header := make([]byte, headerSize)
+	var data []byte
+	for off := int64(0); off < seg.size; {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		keySize := binary.BigEndian.Uint32(header[4:])
+		valueSize := binary.BigEndian.Uint64(header[8:])
+		tombstone := keySize&tombstoneFlag != 0
+		batch := keySize&batchFlag != 0
+		keySize &^= tombstoneFlag | batchFlag
+		n := recordSize(int(keySize), int(valueSize))
+		if n > seg.size-off {
+			return fmt.Errorf("record at %d of segment %d is truncated", off, seg.id)
+		}
+		if int64(cap(data)) < n-headerSize {
+			data = make([]byte, n-headerSize)
+		}
+		data = data[:n-headerSize]
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		var err error
+		switch {
+		case batch:
+			base := off + headerSize
+			err = walkBatch(off, data, func(key []byte, valueSize int, valueOff int64, tombstone bool) error {
+				if tombstone {
+					return nil
+				}
+				value := data[valueOff-base:][:valueSize]
+				return fn(key, value, valueEntry{segment: seg.id, valueOff: valueOff, valueSize: valueSize})
+			})
+		case !tombstone:
+			valueOff := off + headerSize + int64(keySize)
+			err = fn(data[:keySize], data[keySize:], valueEntry{segment: seg.id, valueOff: valueOff, valueSize: int(valueSize)})
+		}
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// removeObsolete deletes compacted segments oldest first, up to the first one an iterator still reads. db.lock must be held.
+func (db *Database) removeObsolete() error {
+	removed := false
+	for len(db.obsolete) > 0 && db.obsolete[0].refs == 0 {
+		seg := db.obsolete[0]
+		db.fileLock.Lock()
+		seg.f.Close()
+		db.fileLock.Unlock()
+		if err := os.Remove(segmentPath(db.path, seg.id)); err != nil {
+			return err
+		}
+		if err := os.Remove(hintPath(db.path, seg.id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		db.obsolete = db.obsolete[1:]
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(db.path)
+}
+
+// writeOutputs copies the records of snapshot into segments firstID, firstID+1, ..., at most n of them.
+func (db *Database) writeOutputs(snapshot *btreemap.BTreeMap[string, valueEntry], inputs map[uint32]*segment, firstID uint32, n int) ([]*segment, map[string]valueEntry, error) {
+	o := &outputWriter{db: db, firstID: firstID, n: n}
+	compacted := make(map[string]valueEntry, snapshot.Len())
+	var value []byte
+	for key, e := range snapshot.Ascend(btreemap.Min[string](), btreemap.Max[string]()) {
+		if cap(value) < e.valueSize {
+			value = make([]byte, e.valueSize)
+		}
+		value = value[:e.valueSize]
+		if _, err := inputs[e.segment].f.ReadAt(value, e.valueOff); err != nil {
+			o.abort()
+			return o.outputs, nil, err
+		}
+		to, err := o.add([]byte(key), value)
+		if err != nil {
+			return o.outputs, nil, err
+		}
+		compacted[key] = to
+	}
+	if err := o.close(); err != nil {
+		return o.outputs, nil, err
+	}
+	return o.outputs, compacted, syncDir(db.path)
+}
+
+// outputWriter writes the records compaction keeps into segments firstID, firstID+1, ..., at most n of them.
+// An output is written to a .tmp file and renamed once it is complete and synced, it is handed to finished before
+// its hint is written so an output whose hint fails is still owned by the caller.
+type outputWriter struct {
+	db       *Database
+	firstID  uint32
+	n        int
+	outputs  []*segment         // the complete ones
+	finished func(out *segment) // called with every output once it is complete, if set
+
+	tmp    *os.File
+	w      *bufio.Writer
+	out    *segment
+	hint   []byte
+	record []byte
+}
+
+// add appends the record of key and value to the current output and returns where the value is.
+// The output is closed when it fails.
+func (o *outputWriter) add(key, value []byte) (valueEntry, error) {
+	if o.out != nil && o.out.size >= o.db.opts.SegmentSize && len(o.outputs) < o.n-1 {
+		if err := o.finish(); err != nil {
+			return valueEntry{}, err
+		}
+	}
+	if o.out == nil {
+		id := o.firstID + uint32(len(o.outputs))
+		f, err := os.Create(segmentPath(o.db.path, id) + tmpSuffix)
+		if err != nil {
+			return valueEntry{}, err
+		}
+		o.tmp, o.w, o.out = f, bufio.NewWriterSize(f, 1024*1024), &segment{id: id, f: f}
+	}
+	o.record = appendRecordBytes(o.record[:0], key, value, false)
+	if _, err := o.w.Write(o.record); err != nil {
+		o.abort()
+		return valueEntry{}, err
+	}
+	e := valueEntry{segment: o.out.id, valueOff: o.out.size + headerSize + int64(len(key)), valueSize: len(value)}
+	o.hint = appendHint(o.hint, key, len(value), e.valueOff, false)
+	o.out.size += int64(len(o.record))
+	return e, nil
+}
+
+func (o *outputWriter) finish() error {
+	err := o.w.Flush()
+	if err == nil {
+		err = o.tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(o.tmp.Name(), segmentPath(o.db.path, o.out.id))
+	}
+	if err != nil {
+		o.abort()
+		return err
+	}
+	// the output is in place and owned by the caller before the hint, which may fail, is written
+	out, hint := o.out, o.hint
+	o.outputs = append(o.outputs, out)
+	if o.finished != nil {
+		o.finished(out)
+	}
+	o.out, o.hint = nil, nil
+	return writeHint(o.db.path, out.id, out.size, hint)
+}
+
+// close finishes the last output.
+func (o *outputWriter) close() error {
+	if o.out == nil {
+		return nil
+	}
+	return o.finish()
+}
+
+// abort closes the output being written, its .tmp file is removed on open.
+func (o *outputWriter) abort() {
+	if o.out != nil {
+		o.tmp.Close()
+		o.out = nil
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
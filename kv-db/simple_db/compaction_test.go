@@ -0,0 +1,163 @@
+package simple_db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCompactWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	opts.SegmentSize = 4096
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, keys, rounds = 4, 200, 50
+	// every writer owns the keys i%writers == w, so its own Gets see its latest Put
+	models := make([]map[string]string, writers)
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		models[w] = make(map[string]string)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				for i := w; i < keys; i += writers {
+					key := fmt.Sprintf("key%03d", i)
+					if i%7 == round%7 {
+						if err := db.Delete([]byte(key)); err != nil {
+							errs <- err
+							return
+						}
+						delete(models[w], key)
+						continue
+					}
+					value := fmt.Sprintf("value%d-%d", i, round)
+					if err := db.Put([]byte(key), []byte(value)); err != nil {
+						errs <- err
+						return
+					}
+					models[w][key] = value
+					got, err := db.Get([]byte(key))
+					if err != nil || string(got) != value {
+						errs <- fmt.Errorf("%s: got %q %v during compaction, want %q", key, got, err, value)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	compactions := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			compactions++
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if compactions == 0 {
+		t.Fatal("no compaction ran")
+	}
+
+	kvs := make(map[string]string)
+	for _, model := range models {
+		for k, v := range model {
+			kvs[k] = v
+		}
+	}
+	checkState(t, db, kvs)
+	// after a compaction without concurrent writes only live records are left in the sealed segments
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.lock.Lock()
+	for _, seg := range db.segments {
+		if seg != db.active && seg.size != seg.live {
+			t.Errorf("segment %d has %d bytes, %d of them live", seg.id, seg.size, seg.live)
+		}
+	}
+	db.lock.Unlock()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkState(t, db, kvs)
+}
+
+// A compaction output whose hint can't be written is still indexed and served by Get.
+func TestCompactHashedHintFailure(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	opts.HashedKeys = true
+	opts.SegmentSize = 4096
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvs := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := sha256.Sum256([]byte{byte(i)})
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key[:], []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[string(key[:])] = value
+	}
+	// a directory in the way of the hint of the first output makes writing it fail
+	db.lock.Lock()
+	firstOutput := db.nextID
+	db.lock.Unlock()
+	if err := os.MkdirAll(hintPath(dir, firstOutput)+"/x", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err == nil {
+		t.Fatal("compaction succeeded without the hint")
+	}
+	db.lock.Lock()
+	_, ok := db.segments[firstOutput]
+	db.lock.Unlock()
+	if !ok {
+		t.Fatal("output without a hint isn't registered")
+	}
+	for k, v := range kvs {
+		got, err := db.Get([]byte(k))
+		if err != nil || string(got) != v {
+			t.Fatalf("got %q %v, want %q", got, err, v)
+		}
+	}
+	if err := os.RemoveAll(hintPath(dir, firstOutput)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if st := db.IndexStats(); st.Keys != len(kvs) {
+		t.Fatalf("%d keys indexed, want %d", st.Keys, len(kvs))
+	}
+}
@@ -1,138 +1,465 @@
 package simple_db
 
+/* Bitcask-style store: an in-memory index of every key pointing into append-only segment files.
+The index is a B-tree ordered by key, so it supports range scans and iterators (see iterator.go),
+or with Options.HashedKeys a hash table for 32-byte hashed keys that needs far less memory (see hashindex.go).
+path is a directory of numbered segments (000000001.data, ...). Writes go to the active segment,
+which rolls over to a new one once it reaches Options.SegmentSize. Sealed segments are never written again,
+compaction rewrites them (see compaction.go).
+
+A record is crc(4) | keySize(4) | valueSize(8) | key | value, crc is the CRC-32C of everything behind it.
+Deletes append a tombstone record: the high bit of keySize is set and the value is empty.
+A batch is written as one record so it is replayed all or nothing (see batch.go).
+*/
+
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
+	"hash/crc32"
+	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RaduBerinde/btreemap"
+)
+
+var errClosed = errors.New("database closed")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	headerSize    = 16
+	tombstoneFlag = 1 << 31
+	batchFlag     = 1 << 30
+	maxKeySize    = batchFlag - 1
 )
 
 type valueEntry struct {
-	entryOff  int64
+	segment   uint32
+	valueOff  int64
 	valueSize int
 }
 
+func recordSize(keySize int, valueSize int) int64 {
+	return headerSize + int64(keySize) + int64(valueSize)
+}
+
+type Durability int
+
+const (
+	// SyncNone buffers up to 256 KiB of records and never fsyncs, a crash loses what the OS didn't write back yet.
+	SyncNone Durability = iota
+	// SyncInterval writes and fsyncs the buffered records every Options.SyncInterval (group commit),
+	// a crash loses at most the last interval.
+	SyncInterval
+	// SyncAlways writes and fsyncs every Put and Delete before it returns.
+	SyncAlways
+)
+
+type Options struct {
+	Durability   Durability
+	SyncInterval time.Duration
+
+	// Roll over to a new segment once the active one reaches this size.
+	SegmentSize int64
+	// Compact in the background once stale records and tombstones make up this fraction of the sealed segments, 0 disables it.
+	CompactionRatio float64
+	// Don't compact sealed segments smaller than this in total.
+	CompactionMinSize int64
+
+	// CacheSize is the memory of the value cache in bytes, 0 disables it (see cache.go).
+	CacheSize int64
+
+	// HashedKeys indexes the keys in a hash table that needs a fraction of the memory of the B-tree, for keys that are
+	// all 32 bytes of a cryptographic hash. Iterators and DeleteRange aren't supported then (see hashindex.go).
+	// It doesn't change the files, a database can be opened in either mode.
+	HashedKeys bool
+	// ExpectedKeys presizes the hashed index, so it isn't rehashed while it grows to that many keys.
+	ExpectedKeys int64
+}
+
+var DefaultOptions = Options{
+	Durability:        SyncNone,
+	SyncInterval:      10 * time.Millisecond,
+	SegmentSize:       256 * 1024 * 1024,
+	CompactionRatio:   0.5,
+	CompactionMinSize: 64 * 1024 * 1024,
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	live int64 // bytes of the records kvEntries points to, the rest of the segment is garbage
+	refs int   // open iterators reading the segment, compaction deletes it only once they are released
+}
+
 type Database struct {
-	kvEntries map[string]valueEntry
-	f         *os.File
-	filesize  int64
+	kvEntries *btreemap.BTreeMap[string, valueEntry] // nil with Options.HashedKeys
+	hashed    *hashIndex                             // only with Options.HashedKeys
+	path      string
+	opts      Options
+	segments  map[uint32]*segment
+	active    *segment
+	nextID    uint32
 	lock      sync.Mutex
-	appendBuf []byte
+	appendBuf []byte // tail of the active segment that isn't written yet
+	hintBuf   []byte // hint entries of the active segment
+	hintWg    sync.WaitGroup
+	closed    bool
+	recovery  RecoveryReport
+	cache     *valueCache   // nil without Options.CacheSize
+	done      chan struct{} // stops the SyncInterval goroutine
+	syncWg    sync.WaitGroup
+
+	// fileLock is held for reading while reading a segment without db.lock, compaction takes it to drop segments
+	fileLock   sync.RWMutex
+	obsolete   []*segment // compacted segments that iterators still read, oldest first
+	compactMu  sync.Mutex
+	compacting atomic.Bool
+	// keys changed while a hashed compaction runs, with their entries before, it copies the records live as of its start
+	compactPrior map[string]priorEntry
 }
 
 func NewDatabase(path string) (*Database, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		return nil, err
-	}
-
-	stat, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-
-	filesize := stat.Size()
-	off := int64(0)
-	reader := bufio.NewReader(f)
-	kvEntries := make(map[string]valueEntry)
-	for off < filesize {
-		data := make([]byte, 8)
-		// TODO: check error
-		io.ReadFull(reader, data)
-		totalSize := binary.BigEndian.Uint32(data)
-		keySize := binary.BigEndian.Uint32(data[4:])
-		valueSize := totalSize - keySize
-		key := make([]byte, keySize)
-		value := make([]byte, valueSize)
-		io.ReadFull(reader, key)
-		io.ReadFull(reader, value)
-		kvEntries[string(key)] = valueEntry{
-			entryOff:  off,
-			valueSize: int(valueSize),
-		}
-		off += 8 + int64(len(key)+len(value))
-	}
-
-	return &Database{
-		kvEntries: kvEntries,
-		f:         f,
-		filesize:  filesize,
-		lock:      sync.Mutex{},
-	}, nil
+	return NewDatabaseWithOptions(path, DefaultOptions)
 }
 
 func (db *Database) Get(key []byte) ([]byte, error) {
 	db.lock.Lock()
-	v, ok := db.kvEntries[string(key)]
+	if db.closed {
+		db.lock.Unlock()
+		return nil, errClosed
+	}
+	if db.hashed != nil {
+		return db.getHashed(key)
+	}
+	_, v, ok := db.kvEntries.Get(string(key))
 	if !ok {
 		db.lock.Unlock()
 		return nil, errors.New("not found")
 	}
 
 	value := make([]byte, v.valueSize)
-	actualFileSize := db.filesize - int64(len(db.appendBuf))
-	if v.entryOff >= actualFileSize {
-		copy(value, db.appendBuf[v.entryOff+8+int64(len(key))-actualFileSize:])
+	seg := db.segments[v.segment]
+	actualFileSize := db.active.size - int64(len(db.appendBuf))
+	if seg == db.active && v.valueOff >= actualFileSize {
+		copy(value, db.appendBuf[v.valueOff-actualFileSize:])
 		db.lock.Unlock()
 	} else {
-		// early unlock as reading the file is threadsafe
+		// early unlock as reading the file is threadsafe, fileLock keeps compaction from closing it meanwhile
+		db.fileLock.RLock()
 		db.lock.Unlock()
-		n, err := db.f.ReadAt(value, v.entryOff+8+int64(len(key)))
+		loc := cacheKey{v.segment, v.valueOff}
+		if db.cache != nil {
+			if cached, ok := db.cache.get(loc); ok {
+				db.fileLock.RUnlock()
+				copy(value, cached)
+				return value, nil
+			}
+		}
+		n, err := seg.f.ReadAt(value, v.valueOff)
+		db.fileLock.RUnlock()
 		if err != nil {
 			return nil, err
 		}
 		if n != v.valueSize {
 			return nil, errors.New("full read failed")
 		}
+		if db.cache != nil {
+			db.cache.add(loc, bytes.Clone(value))
+		}
 	}
 	return value, nil
 }
 
 func (db *Database) Put(key []byte, value []byte) error {
-	data := make([]byte, 8)
-	binary.BigEndian.PutUint32(data, uint32(len(key)+len(value)))
-	binary.BigEndian.PutUint32(data[4:], uint32(len(key)))
-	s := string(key)
-
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	db.appendBuf = append(db.appendBuf, data...)
-	db.appendBuf = append(db.appendBuf, key...)
-	db.appendBuf = append(db.appendBuf, value...)
-	off := db.filesize
-	db.filesize += int64(8 + len(key) + len(value))
-
-	if len(db.appendBuf) > 256*1024 {
-		n, err := db.f.WriteAt(db.appendBuf, db.filesize-int64(len(db.appendBuf)))
-		if err != nil {
+	if db.closed {
+		return errClosed
+	}
+	e, err := db.appendRecord(key, value, false)
+	if err != nil {
+		return err
+	}
+	if err := db.index(string(key), e); err != nil {
+		return err
+	}
+	db.maybeCompact()
+	return nil
+}
+
+// lookup returns the entry of key, db.lock must be held.
+func (db *Database) lookup(key string) (valueEntry, bool, error) {
+	if db.hashed != nil {
+		if len(key) != hashedKeySize {
+			return valueEntry{}, false, nil
+		}
+		return db.hashed.get(key)
+	}
+	_, e, ok := db.kvEntries.Get(key)
+	return e, ok, nil
+}
+
+// index points key to e, the record it pointed to becomes garbage. db.lock must be held.
+// Only the hashed index fails, if it can't read a key to compare it.
+func (db *Database) index(key string, e valueEntry) error {
+	var old valueEntry
+	var ok bool
+	if db.hashed != nil {
+		var err error
+		if old, ok, err = db.hashed.put(key, e); err != nil {
 			return err
 		}
+		db.replaced(key, old, ok)
+	} else {
+		_, old, ok = db.kvEntries.ReplaceOrInsert(key, e)
+	}
+	if ok {
+		db.segments[old.segment].live -= recordSize(len(key), old.valueSize)
+	}
+	db.segments[e.segment].live += recordSize(len(key), e.valueSize)
+	return nil
+}
+
+// unindex removes key, its record becomes garbage. db.lock must be held.
+func (db *Database) unindex(key string) error {
+	var old valueEntry
+	var ok bool
+	if db.hashed != nil {
+		var err error
+		if old, ok, err = db.hashed.delete(key); err != nil {
+			return err
+		}
+		db.replaced(key, old, ok)
+	} else {
+		_, old, ok = db.kvEntries.Delete(key)
+	}
+	if ok {
+		db.segments[old.segment].live -= recordSize(len(key), old.valueSize)
+	}
+	return nil
+}
+
+// appendRecord appends a record to the active segment and returns where it is, db.lock must be held.
+func (db *Database) appendRecord(key []byte, value []byte, tombstone bool) (valueEntry, error) {
+	if len(key) > maxKeySize {
+		return valueEntry{}, fmt.Errorf("key of %d bytes too large", len(key))
+	}
+	if db.hashed != nil {
+		if err := checkHashed(recordSize(len(key), len(value)), key); err != nil {
+			return valueEntry{}, err
+		}
+	}
+	e := valueEntry{segment: db.active.id, valueOff: db.active.size + headerSize + int64(len(key)), valueSize: len(value)}
+	db.appendBuf = appendRecordBytes(db.appendBuf, key, value, tombstone)
+	db.hintBuf = appendHint(db.hintBuf, key, len(value), e.valueOff, tombstone)
+	db.active.size += recordSize(len(key), len(value))
+	return e, db.appended()
+}
 
-		if n != len(db.appendBuf) {
-			return errors.New("failed to write")
+// appended writes and syncs the records appended to appendBuf as the durability mode asks
+// and rolls the active segment over once it is full, db.lock must be held.
+func (db *Database) appended() error {
+	if len(db.appendBuf) > 256*1024 || db.opts.Durability == SyncAlways {
+		if err := db.flush(); err != nil {
+			return err
 		}
-		db.appendBuf = make([]byte, 0)
 	}
-	db.kvEntries[s] = valueEntry{entryOff: off, valueSize: len(value)}
+	if db.opts.Durability == SyncAlways {
+		if err := db.active.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if db.active.size >= db.opts.SegmentSize {
+		return db.rollover()
+	}
+	return nil
+}
+
+func appendRecordBytes(buf []byte, key []byte, value []byte, tombstone bool) []byte {
+	keySize := uint32(len(key))
+	if tombstone {
+		keySize |= tombstoneFlag
+	}
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	buf = binary.BigEndian.AppendUint32(buf, keySize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(value)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.BigEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+4:], crcTable))
+	return buf
+}
 
+// flush writes appendBuf to the end of the active segment, db.lock must be held.
+func (db *Database) flush() error {
+	if len(db.appendBuf) == 0 {
+		return nil
+	}
+	n, err := db.active.f.WriteAt(db.appendBuf, db.active.size-int64(len(db.appendBuf)))
+	if err != nil {
+		return err
+	}
+
+	if n != len(db.appendBuf) {
+		return errors.New("failed to write")
+	}
+	db.appendBuf = make([]byte, 0)
 	return nil
 }
 
+// rollover seals the active segment, writes its hint in the background and starts the next segment. db.lock must be held.
+func (db *Database) rollover() error {
+	if db.active != nil {
+		if err := db.flush(); err != nil {
+			return err
+		}
+		id, size, entries := db.active.id, db.active.size, db.hintBuf
+		db.hintBuf = nil
+		db.hintWg.Add(1)
+		f := db.active.f
+		go func() {
+			defer db.hintWg.Done()
+			// the hint must not cover records a crash can still tear, a closed file means compaction deleted the segment
+			if err := f.Sync(); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					log.Printf("simple_db: syncing segment %d failed: %v", id, err)
+				}
+				return
+			}
+			// without the hint, opening replays the segment
+			if err := writeHint(db.path, id, size, entries); err != nil {
+				log.Printf("simple_db: writing hint of segment %d failed: %v", id, err)
+			}
+		}()
+	}
+	seg, err := db.createSegment(db.nextID)
+	if err != nil {
+		return err
+	}
+	db.nextID++
+	db.segments[seg.id] = seg
+	db.active = seg
+	return nil
+}
+
+// Delete appends a tombstone for key, so the key stays deleted when the log is replayed.
+// Deleting a missing key is a no-op.
 func (db *Database) Delete(key []byte) error {
-	return errors.ErrUnsupported
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return errClosed
+	}
+	if _, ok, err := db.lookup(string(key)); !ok {
+		return err
+	}
+	if _, err := db.appendRecord(key, nil, true); err != nil {
+		return err
+	}
+	if err := db.unindex(string(key)); err != nil {
+		return err
+	}
+	db.maybeCompact()
+	return nil
 }
 
 func (db *Database) Has(key []byte) (bool, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	_, ok := db.kvEntries[string(key)]
-	return ok, nil
+	if db.closed {
+		return false, errClosed
+	}
+	_, ok, err := db.lookup(string(key))
+	return ok, err
+}
+
+// Sync writes the buffered records and fsyncs the active segment, sealed segments are synced when they roll over.
+func (db *Database) Sync() error {
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return errClosed
+	}
+	if err := db.flush(); err != nil {
+		db.lock.Unlock()
+		return err
+	}
+	f := db.active.f
+	// fsync without the lock so writes go on meanwhile
+	db.lock.Unlock()
+	// a closed file was rolled over and compacted, compaction synced its records
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// SyncKeyValue implements ethdb.KeyValueSyncer.
+func (db *Database) SyncKeyValue() error {
+	return db.Sync()
+}
+
+func (db *Database) syncLoop() {
+	defer db.syncWg.Done()
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Sync(); err != nil && !errors.Is(err, errClosed) {
+				log.Printf("simple_db: syncing %s failed: %v", db.path, err)
+			}
+		case <-db.done:
+			return
+		}
+	}
 }
 
 func (db *Database) Close() error {
-	// TODO: error & threadsafe
-	db.f.WriteAt(db.appendBuf, db.filesize-int64(len(db.appendBuf)))
-	return db.f.Close()
+	// wait for a running compaction, it owns the sealed segments until it swapped them
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return errClosed
+	}
+	db.closed = true
+	db.lock.Unlock()
+	if db.done != nil {
+		close(db.done)
+		db.syncWg.Wait()
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.flush()
+	if err == nil {
+		err = db.active.f.Sync()
+	}
+	// the hint must not cover records that didn't make it to disk
+	if err == nil {
+		err = writeHint(db.path, db.active.id, db.active.size, db.hintBuf)
+	}
+	db.hintWg.Wait()
+	// segments of released iterators are deleted, the rest is compacted again after reopening
+	if rerr := db.removeObsolete(); rerr != nil && err == nil {
+		err = rerr
+	}
+	for _, seg := range db.obsolete {
+		seg.f.Close()
+	}
+	for _, seg := range db.segments {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
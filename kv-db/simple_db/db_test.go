@@ -0,0 +1,199 @@
+package simple_db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeleteSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	// the puts and their tombstones end up in different segments
+	opts.SegmentSize = 256
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[key] = value
+	}
+	for i := 0; i < 20; i += 2 {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(kvs, key)
+	}
+	// deleting a missing key is a no-op
+	if err := db.Delete([]byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, kvs)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, kvs)
+	for i := 0; i < 20; i += 2 {
+		if has, _ := db.Has([]byte(fmt.Sprintf("key%d", i))); has {
+			t.Fatalf("key%d came back after reopening", i)
+		}
+	}
+	// a key put again after its tombstone is live on the next open
+	if err := db.Put([]byte("key0"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	kvs["key0"] = "again"
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkState(t, db, kvs)
+}
+
+// onDisk reports whether every record written so far reached the active segment file.
+func onDisk(t *testing.T, db *Database) bool {
+	t.Helper()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	info, err := os.Stat(segmentPath(db.path, db.active.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(db.appendBuf) == 0 && info.Size() == db.active.size
+}
+
+func TestDurability(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		durability Durability
+	}{
+		{"SyncNone", SyncNone},
+		{"SyncInterval", SyncInterval},
+		{"SyncAlways", SyncAlways},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := DefaultOptions
+			opts.Durability = tc.durability
+			opts.SyncInterval = time.Millisecond
+			db, err := NewDatabaseWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvs := make(map[string]string)
+			for i := 0; i < 100; i++ {
+				key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+				if err := db.Put([]byte(key), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				kvs[key] = value
+				if i%10 == 0 {
+					if err := db.Delete([]byte(key)); err != nil {
+						t.Fatal(err)
+					}
+					delete(kvs, key)
+				}
+				if tc.durability == SyncAlways && !onDisk(t, db) {
+					t.Fatalf("key%d isn't written through", i)
+				}
+			}
+			switch tc.durability {
+			case SyncNone:
+				if onDisk(t, db) {
+					t.Fatal("SyncNone wrote the buffered records")
+				}
+			case SyncInterval:
+				// syncLoop writes the buffer without another write or Sync
+				deadline := time.Now().Add(5 * time.Second)
+				for !onDisk(t, db) {
+					if time.Now().After(deadline) {
+						t.Fatal("syncLoop didn't write the buffered records")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if err := db.Put([]byte("last"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			kvs["last"] = "value"
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if !onDisk(t, db) {
+				t.Fatal("Sync didn't write the buffered records")
+			}
+			checkState(t, db, kvs)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = NewDatabaseWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkState(t, db, kvs)
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	opts := DefaultOptions
+	// the sync goroutine has to stop too
+	opts.Durability = SyncInterval
+	db, err := NewDatabaseWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	// an open iterator doesn't keep Close from succeeding
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); !errors.Is(err, errClosed) {
+		t.Fatalf("second Close: %v, want %v", err, errClosed)
+	}
+	if _, err := db.Get([]byte("key")); !errors.Is(err, errClosed) {
+		t.Fatalf("Get after Close: %v", err)
+	}
+	if _, err := db.Has([]byte("key")); !errors.Is(err, errClosed) {
+		t.Fatalf("Has after Close: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("other")); !errors.Is(err, errClosed) {
+		t.Fatalf("Put after Close: %v", err)
+	}
+	if err := db.Delete([]byte("key")); !errors.Is(err, errClosed) {
+		t.Fatalf("Delete after Close: %v", err)
+	}
+	if err := db.Sync(); !errors.Is(err, errClosed) {
+		t.Fatalf("Sync after Close: %v", err)
+	}
+	b := db.NewBatch()
+	b.Put([]byte("key"), []byte("batched"))
+	if err := b.Write(); !errors.Is(err, errClosed) {
+		t.Fatalf("batch Write after Close: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package simple_db
+
+/* With Options.HashedKeys the index is an open-addressing hash table instead of the B-tree, for databases whose keys
+are all hashedKeySize bytes of a cryptographic hash (geth's state and our 2-billion-key test dbs).
+A slot holds the first 8 bytes of the key and where its value is, 20 bytes, about 25 bytes per key at the maximum load
+of 80%, where the B-tree costs the key string, its header, the entry and the node overhead, over 100 bytes.
+The key bytes are uniformly distributed, so the prefix is the hash: scaled to the number of slots it picks the home
+slot, which needs no power of two, so a table presized for Options.ExpectedKeys isn't up to twice as large.
+Collisions are resolved by linear probing and deletions shift the following slots back, there are no tombstones.
+
+Two keys sharing a prefix are rare, one pair among some billion keys, but possible: a slot whose prefix matches is only
+taken for the key after the key of its record was read from the segment and compared (recordHasKey).
+Get reads the key along with the value, Put and Delete read it only if the prefix of an existing slot matches,
+and fail if it can't be read.
+
+The on-disk format is the same in both modes. A hash table has no order, so iterators and DeleteRange aren't supported,
+and compaction finds the live records by scanning the segments instead of walking the index (see compactHashed).
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	hashedKeySize = 32
+	// maxHashedRecord bounds records and batches so value offsets fit the 32 bits of a slot, with segments up to maxHashedSegment
+	maxHashedRecord  = 1 << 30
+	maxHashedSegment = 1 << 30
+	minHashSlots     = 1024
+	slotSize         = 20 // unsafe.Sizeof(slot{})
+)
+
+var errUnordered = errors.New("not supported by the hashed index")
+
+// slot is an entry of the hash table, a zero segment marks a free slot as segment ids start at 1.
+type slot struct {
+	prefix    [8]byte
+	segment   uint32
+	valueOff  uint32
+	valueSize uint32
+}
+
+func (s *slot) entry() valueEntry {
+	return valueEntry{segment: s.segment, valueOff: int64(s.valueOff), valueSize: int(s.valueSize)}
+}
+
+func (s *slot) is(e valueEntry) bool {
+	return s.segment == e.segment && int64(s.valueOff) == e.valueOff
+}
+
+type hashIndex struct {
+	slots []slot
+	count int
+	// hasKey tells whether the record of e is the one of key, it reads the key from the segment
+	hasKey func(key string, e valueEntry) (bool, error)
+}
+
+func newHashIndex(expected int64, hasKey func(string, valueEntry) (bool, error)) *hashIndex {
+	h := &hashIndex{hasKey: hasKey}
+	h.resize(max(minHashSlots, uint64(expected)*5/4+1))
+	return h
+}
+
+func (h *hashIndex) resize(n uint64) {
+	old := h.slots
+	h.slots = make([]slot, n)
+	for i := range old {
+		if old[i].segment == 0 {
+			continue
+		}
+		j := h.home(old[i].prefix)
+		for h.slots[j].segment != 0 {
+			j = h.next(j)
+		}
+		h.slots[j] = old[i]
+	}
+}
+
+// home returns the slot the probing for prefix starts at, prefix*len(slots)/2^64.
+func (h *hashIndex) home(prefix [8]byte) uint64 {
+	hi, _ := bits.Mul64(binary.BigEndian.Uint64(prefix[:]), uint64(len(h.slots)))
+	return hi
+}
+
+func (h *hashIndex) next(i uint64) uint64 {
+	if i++; i == uint64(len(h.slots)) {
+		return 0
+	}
+	return i
+}
+
+// distance returns how many slots probing takes from i to j.
+func (h *hashIndex) distance(i, j uint64) uint64 {
+	if j < i {
+		j += uint64(len(h.slots))
+	}
+	return j - i
+}
+
+func prefixOf(key string) (p [8]byte) {
+	copy(p[:], key)
+	return p
+}
+
+// find returns the slot of key or the free slot ending its probe sequence.
+func (h *hashIndex) find(key string) (uint64, bool, error) {
+	p := prefixOf(key)
+	for i := h.home(p); ; i = h.next(i) {
+		s := &h.slots[i]
+		if s.segment == 0 {
+			return i, false, nil
+		}
+		if s.prefix != p {
+			continue
+		}
+		if ok, err := h.hasKey(key, s.entry()); err != nil || ok {
+			return i, ok, err
+		}
+	}
+}
+
+// findEntry returns the slot of key that points to e, it doesn't read the key.
+func (h *hashIndex) findEntry(key string, e valueEntry) (uint64, bool) {
+	p := prefixOf(key)
+	for i := h.home(p); ; i = h.next(i) {
+		s := &h.slots[i]
+		if s.segment == 0 {
+			return i, false
+		}
+		if s.prefix == p && s.is(e) {
+			return i, true
+		}
+	}
+}
+
+// candidates appends the entries whose prefix is the one of key to dst, without reading their keys.
+func (h *hashIndex) candidates(key string, dst []valueEntry) []valueEntry {
+	p := prefixOf(key)
+	for i := h.home(p); h.slots[i].segment != 0; i = h.next(i) {
+		if h.slots[i].prefix == p {
+			dst = append(dst, h.slots[i].entry())
+		}
+	}
+	return dst
+}
+
+func (h *hashIndex) get(key string) (valueEntry, bool, error) {
+	i, ok, err := h.find(key)
+	if !ok {
+		return valueEntry{}, false, err
+	}
+	return h.slots[i].entry(), true, nil
+}
+
+// put points key to e and returns the entry it replaced.
+func (h *hashIndex) put(key string, e valueEntry) (valueEntry, bool, error) {
+	i, ok, err := h.find(key)
+	if err != nil {
+		return valueEntry{}, false, err
+	}
+	var old valueEntry
+	if ok {
+		old = h.slots[i].entry()
+	} else if uint64(h.count+1) > uint64(len(h.slots))*4/5 {
+		h.resize(uint64(len(h.slots)) * 2)
+		// the key isn't in the table, the free slot ending its probe sequence moved
+		i = h.home(prefixOf(key))
+		for h.slots[i].segment != 0 {
+			i = h.next(i)
+		}
+	}
+	if !ok {
+		h.count++
+	}
+	h.slots[i] = slot{prefix: prefixOf(key), segment: e.segment, valueOff: uint32(e.valueOff), valueSize: uint32(e.valueSize)}
+	return old, ok, nil
+}
+
+func (h *hashIndex) delete(key string) (valueEntry, bool, error) {
+	i, ok, err := h.find(key)
+	if !ok {
+		return valueEntry{}, false, err
+	}
+	old := h.slots[i].entry()
+	h.remove(i)
+	return old, true, nil
+}
+
+// remove frees slot i and shifts back the slots behind it that would otherwise be cut off from their home slot.
+func (h *hashIndex) remove(i uint64) {
+	for j := h.next(i); h.slots[j].segment != 0; j = h.next(j) {
+		// j may fill the hole at i if its home slot is not in (i, j]
+		if h.distance(h.home(h.slots[j].prefix), j) >= h.distance(i, j) {
+			h.slots[i] = h.slots[j]
+			i = j
+		}
+	}
+	h.slots[i] = slot{}
+	h.count--
+}
+
+// checkHashed validates a write of the hashed index, a record of recordBytes, with its keys.
+func checkHashed(recordBytes int64, keys ...[]byte) error {
+	for _, key := range keys {
+		if len(key) != hashedKeySize {
+			return fmt.Errorf("key of %d bytes, the hashed index takes keys of %d bytes", len(key), hashedKeySize)
+		}
+	}
+	if recordBytes > maxHashedRecord {
+		return fmt.Errorf("record of %d bytes too large for the hashed index", recordBytes)
+	}
+	return nil
+}
+
+// recordHasKey tells whether the record of e is the one of key, db.lock must be held.
+func (db *Database) recordHasKey(key string, e valueEntry) (bool, error) {
+	off := e.valueOff - int64(len(key))
+	seg := db.segments[e.segment]
+	// db.active is nil while opening replays the segments, seg never is
+	if seg == db.active {
+		actualFileSize := db.active.size - int64(len(db.appendBuf))
+		if off >= actualFileSize {
+			return string(db.appendBuf[off-actualFileSize:][:len(key)]) == key, nil
+		}
+	}
+	stored := make([]byte, len(key))
+	if _, err := seg.f.ReadAt(stored, off); err != nil {
+		return false, fmt.Errorf("reading key at %d of segment %d: %w", off, e.segment, err)
+	}
+	return string(stored) == key, nil
+}
+
+// getHashed is Get with the hashed index, db.lock must be held and is released.
+func (db *Database) getHashed(key []byte) ([]byte, error) {
+	if len(key) != hashedKeySize {
+		db.lock.Unlock()
+		return nil, errors.New("not found")
+	}
+	var buf [2]valueEntry
+	candidates := db.hashed.candidates(string(key), buf[:0])
+	// the records of the candidates, key and value, are read and the one with the key wins
+	actualFileSize := db.active.size - int64(len(db.appendBuf))
+	var onDisk []valueEntry
+	for _, e := range candidates {
+		off := e.valueOff - hashedKeySize
+		if db.segments[e.segment] == db.active && off >= actualFileSize {
+			record := db.appendBuf[off-actualFileSize:][:hashedKeySize+e.valueSize]
+			if bytes.Equal(record[:hashedKeySize], key) {
+				db.lock.Unlock()
+				return bytes.Clone(record[hashedKeySize:]), nil
+			}
+		} else {
+			onDisk = append(onDisk, e)
+		}
+	}
+	if len(onDisk) == 0 {
+		db.lock.Unlock()
+		return nil, errors.New("not found")
+	}
+	segments := make([]*segment, len(onDisk))
+	for i, e := range onDisk {
+		segments[i] = db.segments[e.segment]
+	}
+	db.fileLock.RLock()
+	db.lock.Unlock()
+	defer db.fileLock.RUnlock()
+	for i, e := range onDisk {
+		loc := cacheKey{e.segment, e.valueOff}
+		record, ok := []byte(nil), false
+		if db.cache != nil {
+			record, ok = db.cache.get(loc)
+		}
+		if !ok {
+			record = make([]byte, hashedKeySize+e.valueSize)
+			if _, err := segments[i].f.ReadAt(record, e.valueOff-hashedKeySize); err != nil {
+				return nil, err
+			}
+			if db.cache != nil {
+				db.cache.add(loc, record)
+			}
+		}
+		if bytes.Equal(record[:hashedKeySize], key) {
+			return bytes.Clone(record[hashedKeySize:]), nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// IndexStats describe the memory of the index.
+type IndexStats struct {
+	Keys  int
+	Slots int // of the hashed index, 0 for the B-tree
+	Bytes int64
+}
+
+func (s IndexStats) String() string {
+	if s.Slots == 0 {
+		return fmt.Sprintf("b-tree index, %d keys", s.Keys)
+	}
+	return fmt.Sprintf("hashed index, %d keys in %d slots, %.1fMiB, %.1f bytes per key",
+		s.Keys, s.Slots, float64(s.Bytes)/(1024*1024), float64(s.Bytes)/math.Max(float64(s.Keys), 1))
+}
+
+// IndexStats returns the size of the index, the memory only for the hashed index.
+func (db *Database) IndexStats() IndexStats {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.hashed == nil {
+		return IndexStats{Keys: db.kvEntries.Len()}
+	}
+	return IndexStats{Keys: db.hashed.count, Slots: len(db.hashed.slots), Bytes: int64(len(db.hashed.slots)) * slotSize}
+}
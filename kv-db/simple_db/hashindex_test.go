@@ -0,0 +1,315 @@
+package simple_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// testIndex is a hashIndex over an in-memory record store, every entry is a distinct offset.
+type testIndex struct {
+	*hashIndex
+	keys    map[valueEntry]string // the key of the record of every entry
+	off     int64
+	readErr error // returned by hasKey if set
+}
+
+func newTestIndex() *testIndex {
+	ti := &testIndex{keys: make(map[valueEntry]string)}
+	ti.hashIndex = newHashIndex(0, func(key string, e valueEntry) (bool, error) {
+		if ti.readErr != nil {
+			return false, ti.readErr
+		}
+		return ti.keys[e] == key, nil
+	})
+	return ti
+}
+
+func (ti *testIndex) record(key string) valueEntry {
+	ti.off += 64
+	e := valueEntry{segment: 1, valueOff: ti.off, valueSize: 1}
+	ti.keys[e] = key
+	return e
+}
+
+// check compares the index to model and verifies that every slot is reachable from its home slot.
+func (ti *testIndex) check(t *testing.T, model map[string]valueEntry) {
+	t.Helper()
+	if ti.count != len(model) {
+		t.Fatalf("%d keys indexed, want %d", ti.count, len(model))
+	}
+	used := 0
+	for i := range ti.slots {
+		s := &ti.slots[i]
+		if s.segment == 0 {
+			continue
+		}
+		used++
+		for j := ti.home(s.prefix); j != uint64(i); j = ti.next(j) {
+			if ti.slots[j].segment == 0 {
+				t.Fatalf("slot %d is cut off from its home slot %d by the free slot %d", i, ti.home(s.prefix), j)
+			}
+		}
+	}
+	if used != len(model) {
+		t.Fatalf("%d slots used, want %d", used, len(model))
+	}
+	for key, want := range model {
+		e, ok, err := ti.get(key)
+		if err != nil || !ok || e != want {
+			t.Fatalf("key %x: got %+v %v %v, want %+v", key, e, ok, err, want)
+		}
+	}
+}
+
+// collidingKey returns a 32-byte key with prefix whose other bytes are random.
+func collidingKey(rnd *rand.Rand, prefix uint64) string {
+	key := make([]byte, hashedKeySize)
+	binary.BigEndian.PutUint64(key, prefix)
+	rnd.Read(key[8:])
+	return string(key)
+}
+
+func TestHashIndexModel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ti := newTestIndex()
+	model := make(map[string]valueEntry)
+	// few prefixes, so keys share them, and prefixes next to each other and around the wraparound at the end
+	// of the table, so their home slots collide and probe sequences run into each other
+	prefixes := []uint64{0, 1, 2, 1 << 50, 1<<50 + 1, ^uint64(0), ^uint64(0) - 1, ^uint64(0) - 1<<50}
+	var keys []string
+	for i := 0; i < 3000; i++ {
+		keys = append(keys, collidingKey(rnd, prefixes[rnd.Intn(len(prefixes))]))
+	}
+	slots := len(ti.slots)
+	for i := 0; i < 20000; i++ {
+		key := keys[rnd.Intn(len(keys))]
+		if rnd.Intn(3) == 0 {
+			old, ok, err := ti.delete(key)
+			want, inModel := model[key]
+			if err != nil || ok != inModel || old != want {
+				t.Fatalf("delete %x: got %+v %v %v, want %+v %v", key, old, ok, err, want, inModel)
+			}
+			delete(model, key)
+		} else {
+			e := ti.record(key)
+			old, ok, err := ti.put(key, e)
+			want, inModel := model[key]
+			if err != nil || ok != inModel || old != want {
+				t.Fatalf("put %x: got %+v %v %v, want %+v %v", key, old, ok, err, want, inModel)
+			}
+			model[key] = e
+		}
+		if i%500 == 0 {
+			ti.check(t, model)
+		}
+	}
+	ti.check(t, model)
+	if len(ti.slots) == slots {
+		t.Fatalf("the index didn't grow from %d slots with %d keys", slots, len(model))
+	}
+	// deleting everything and reinserting it leaves the same contents
+	for key := range model {
+		if _, ok, err := ti.delete(key); !ok || err != nil {
+			t.Fatalf("delete %x: %v %v", key, ok, err)
+		}
+	}
+	ti.check(t, map[string]valueEntry{})
+	for key := range model {
+		model[key] = ti.record(key)
+		if _, ok, err := ti.put(key, model[key]); ok || err != nil {
+			t.Fatalf("put %x: %v %v", key, ok, err)
+		}
+	}
+	ti.check(t, model)
+}
+
+func TestHashIndexReadError(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	ti := newTestIndex()
+	a, b := collidingKey(rnd, 7), collidingKey(rnd, 7)
+	e := ti.record(a)
+	if _, _, err := ti.put(a, e); err != nil {
+		t.Fatal(err)
+	}
+	ti.readErr = errors.New("read failed")
+	// a key with the prefix of a slot needs the key of its record, one with another prefix doesn't
+	if _, _, err := ti.get(b); err != ti.readErr {
+		t.Fatalf("get with an unreadable key: %v", err)
+	}
+	if _, _, err := ti.put(b, ti.record(b)); err != ti.readErr {
+		t.Fatalf("put with an unreadable key: %v", err)
+	}
+	if _, _, err := ti.delete(a); err != ti.readErr {
+		t.Fatalf("delete with an unreadable key: %v", err)
+	}
+	if _, ok, err := ti.get(collidingKey(rnd, 8)); ok || err != nil {
+		t.Fatalf("get of another prefix: %v %v", ok, err)
+	}
+	ti.readErr = nil
+	ti.check(t, map[string]valueEntry{a: e})
+}
+
+func hashedOptions() Options {
+	opts := DefaultOptions
+	opts.HashedKeys = true
+	opts.SegmentSize = 4096
+	opts.CompactionRatio = 0
+	return opts
+}
+
+// checkHashedState compares a database with the hashed index to kvs.
+func checkHashedState(t *testing.T, db *Database, kvs map[string]string) {
+	t.Helper()
+	if st := db.IndexStats(); st.Keys != len(kvs) {
+		t.Fatalf("%d keys indexed, want %d", st.Keys, len(kvs))
+	}
+	// the live bytes of the segments are the records of kvs, overwritten and deleted ones are garbage
+	var live, want int64
+	db.lock.Lock()
+	for _, seg := range db.segments {
+		live += seg.live
+	}
+	db.lock.Unlock()
+	for k, v := range kvs {
+		want += recordSize(len(k), len(v))
+	}
+	if live != want {
+		t.Fatalf("%d live bytes, want %d", live, want)
+	}
+	for k, v := range kvs {
+		got, err := db.Get([]byte(k))
+		if err != nil || string(got) != v {
+			t.Fatalf("key %x: got %q %v, want %q", k, got, err, v)
+		}
+	}
+}
+
+func TestHashedModel(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(3))
+	opts := hashedOptions()
+	opts.CacheSize = 64 * 1024
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys sharing their prefix, so Get, Put, Delete and compaction tell them apart by the key of the record
+	var keys []string
+	for i := 0; i < 300; i++ {
+		keys = append(keys, collidingKey(rnd, uint64(rnd.Intn(20))))
+	}
+	kvs := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			key := keys[rnd.Intn(len(keys))]
+			switch r := rnd.Intn(10); {
+			case r < 3:
+				if err := db.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				delete(kvs, key)
+			case r < 4:
+				b := db.NewBatch()
+				other := keys[rnd.Intn(len(keys))]
+				b.Put([]byte(key), []byte("batched"))
+				b.Delete([]byte(other))
+				b.Put([]byte(other), []byte("reinserted"))
+				if err := b.Write(); err != nil {
+					t.Fatal(err)
+				}
+				kvs[key], kvs[other] = "batched", "reinserted"
+			default:
+				value := fmt.Sprintf("value%d-%d", round, i)
+				if err := db.Put([]byte(key), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				kvs[key] = value
+			}
+			// Get reads candidates from appendBuf, the segments and the cache
+			if i%7 == 0 {
+				k := keys[rnd.Intn(len(keys))]
+				got, err := db.Get([]byte(k))
+				if v, ok := kvs[k]; ok != (err == nil) || string(got) != v {
+					t.Fatalf("key %x: got %q %v, want %q", k, got, err, v)
+				}
+			}
+		}
+		checkHashedState(t, db, kvs)
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		checkHashedState(t, db, kvs)
+		// only live records are left after compacting
+		db.lock.Lock()
+		for _, seg := range db.segments {
+			if seg != db.active && seg.size != seg.live {
+				t.Errorf("segment %d has %d bytes, %d of them live", seg.id, seg.size, seg.live)
+			}
+		}
+		db.lock.Unlock()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDatabaseWithOptions(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+		checkHashedState(t, db, kvs)
+	}
+	defer db.Close()
+	if s := db.CacheStats(); s.Hits == 0 {
+		t.Fatalf("no Get was served from the cache: %v", s)
+	}
+}
+
+// Put, Delete and Has fail if the key of a record with the same prefix can't be read.
+func TestHashedReadError(t *testing.T) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(4))
+	db, err := NewDatabaseWithOptions(dir, hashedOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, b := collidingKey(rnd, 42), collidingKey(rnd, 42)
+	if err := db.Put([]byte(a), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	db.lock.Lock()
+	seg := db.active
+	db.lock.Unlock()
+	// a write-only file makes reading the key of a fail
+	f, err := os.OpenFile(segmentPath(dir, seg.id), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db.lock.Lock()
+	seg.f, f = f, seg.f
+	db.lock.Unlock()
+	if _, err := db.Has([]byte(b)); err == nil {
+		t.Fatal("Has succeeded without reading the colliding key")
+	}
+	if err := db.Delete([]byte(b)); err == nil {
+		t.Fatal("Delete succeeded without reading the colliding key")
+	}
+	if err := db.Put([]byte(b), []byte("b")); err == nil {
+		t.Fatal("Put succeeded without reading the colliding key")
+	}
+	db.lock.Lock()
+	seg.f, f = f, seg.f
+	db.lock.Unlock()
+	if has, err := db.Has([]byte(b)); has || err != nil {
+		t.Fatalf("Has: %v %v", has, err)
+	}
+	got, err := db.Get([]byte(a))
+	if err != nil || string(got) != "a" {
+		t.Fatalf("got %q %v, want %q", got, err, "a")
+	}
+}
@@ -0,0 +1,111 @@
+package simple_db
+
+/* A hint file NNN.hint lists the records of segment NNN without their values, so opening reads only keys and offsets:
+crc(4) | dataSize(8) | entries, an entry is keySize(4) | valueSize(8) | valueOff(8) | key with the tombstone flag in keySize,
+crc is the CRC-32C of everything behind it.
+dataSize is how much of the segment the hint covers, records behind it (appended after reopening) are replayed from the segment.
+
+Hints are written when a segment is sealed, by compaction and on Close. The entries of the active segment are
+kept in memory until then, which costs about keySize+20 bytes per record.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const (
+	hintSuffix     = ".hint"
+	hintHeaderSize = 12
+	hintEntrySize  = 20
+)
+
+func hintPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, hintSuffix))
+}
+
+func appendHint(buf []byte, key []byte, valueSize int, valueOff int64, tombstone bool) []byte {
+	keySize := uint32(len(key))
+	if tombstone {
+		keySize |= tombstoneFlag
+	}
+	buf = binary.BigEndian.AppendUint32(buf, keySize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(valueSize))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(valueOff))
+	return append(buf, key...)
+}
+
+// writeHint atomically replaces the hint of segment id with entries covering dataSize bytes.
+func writeHint(dir string, id uint32, dataSize int64, entries []byte) error {
+	tmp := hintPath(dir, id) + tmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, hintHeaderSize)
+	binary.BigEndian.PutUint64(header[4:], uint64(dataSize))
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, entries)
+	binary.BigEndian.PutUint32(header, crc)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, hintPath(dir, id))
+}
+
+// loadHint indexes the records of seg listed in its hint and returns how much of seg it covers.
+// A missing or damaged hint covers nothing. The entries are appended to hint if it isn't nil.
+// It fails only if an entry can't be indexed.
+func (db *Database) loadHint(seg *segment, hint *[]byte) (int64, error) {
+	data, err := os.ReadFile(hintPath(db.path, seg.id))
+	if err != nil || len(data) < hintHeaderSize {
+		return 0, nil
+	}
+	if crc32.Checksum(data[4:], crcTable) != binary.BigEndian.Uint32(data) {
+		return 0, nil
+	}
+	dataSize := int64(binary.BigEndian.Uint64(data[4:]))
+	if dataSize > seg.size {
+		return 0, nil
+	}
+	entries := data[hintHeaderSize:]
+	for len(entries) > 0 {
+		if len(entries) < hintEntrySize {
+			return 0, nil
+		}
+		keySize := binary.BigEndian.Uint32(entries)
+		valueSize := int(binary.BigEndian.Uint64(entries[4:]))
+		valueOff := int64(binary.BigEndian.Uint64(entries[12:]))
+		tombstone := keySize&tombstoneFlag != 0
+		keySize &^= tombstoneFlag
+		if int(keySize) > len(entries)-hintEntrySize {
+			return 0, nil
+		}
+		key := entries[hintEntrySize : hintEntrySize+keySize]
+		if valueOff+int64(valueSize) > dataSize {
+			return 0, nil
+		}
+		if err := db.apply(seg, key, valueSize, valueOff, tombstone); err != nil {
+			return 0, err
+		}
+		entries = entries[hintEntrySize+keySize:]
+	}
+	if hint != nil {
+		*hint = append(*hint, data[hintHeaderSize:]...)
+	}
+	return dataSize, nil
+}
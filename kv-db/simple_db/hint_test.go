@@ -0,0 +1,115 @@
+package simple_db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RaduBerinde/btreemap"
+)
+
+// indexOf returns the entries of the index and the live bytes of every segment.
+func indexOf(db *Database) (map[string]valueEntry, map[uint32]int64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	entries := make(map[string]valueEntry)
+	for key, e := range db.kvEntries.Ascend(btreemap.Min[string](), btreemap.Max[string]()) {
+		entries[key] = e
+	}
+	live := make(map[uint32]int64)
+	for id, seg := range db.segments {
+		live[id] = seg.live
+	}
+	return entries, live
+}
+
+func TestHintsMatchReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	opts.SegmentSize = 512
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i%37)
+		switch {
+		case i%5 == 0:
+			if err := db.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(kvs, key)
+		case i%7 == 0:
+			b := db.NewBatch()
+			other := fmt.Sprintf("key%d", (i+1)%37)
+			b.Put([]byte(key), []byte("batched"))
+			b.Delete([]byte(other))
+			if err := b.Write(); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = "batched"
+			delete(kvs, other)
+		default:
+			value := fmt.Sprintf("value%d", i)
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = value
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hinted, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hinted.Close()
+	r := hinted.Recovery()
+	if r.Segments < 2 || r.HintedSegments != r.Segments || r.Records != 0 {
+		t.Fatalf("opened %d segments, %d of them from hints, replayed %d records", r.Segments, r.HintedSegments, r.Records)
+	}
+	checkState(t, hinted, kvs)
+
+	// the same segments without their hints are replayed in full
+	replayDir := t.TempDir()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(replayDir, filepath.Base(name)), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replayed, err := NewDatabaseWithOptions(replayDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	if r := replayed.Recovery(); r.HintedSegments != 0 || r.Records == 0 {
+		t.Fatalf("%d segments opened from hints, %d records replayed", r.HintedSegments, r.Records)
+	}
+	checkState(t, replayed, kvs)
+
+	hintedEntries, hintedLive := indexOf(hinted)
+	replayedEntries, replayedLive := indexOf(replayed)
+	for key, e := range replayedEntries {
+		if hintedEntries[key] != e {
+			t.Errorf("key %s: entry %+v from hints, %+v replayed", key, hintedEntries[key], e)
+		}
+	}
+	for id, live := range replayedLive {
+		if hintedLive[id] != live {
+			t.Errorf("segment %d: %d live bytes from hints, %d replayed", id, hintedLive[id], live)
+		}
+	}
+}
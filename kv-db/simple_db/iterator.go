@@ -0,0 +1,144 @@
+package simple_db
+
+/* An iterator walks a copy-on-write clone of the index, so it sees the database as of NewIterator
+and neither blocks nor is affected by later writes. Values are read from the segments when the iterator
+reaches them, the segments are referenced until Release so compaction keeps them on disk meanwhile.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"log"
+
+	"github.com/RaduBerinde/btreemap"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+type iterator struct {
+	db       *Database
+	segments map[uint32]*segment
+	next     func() (string, valueEntry, bool)
+	stop     func()
+	key      []byte
+	value    []byte
+	err      error
+	released bool
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset
+// of database content with a particular key prefix, starting at a particular
+// initial key (or after, if it does not exist).
+func (db *Database) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return &iterator{err: errClosed, released: true}
+	}
+	if db.hashed != nil {
+		return &iterator{err: fmt.Errorf("iterator %w", errUnordered), released: true}
+	}
+	// the values the iterator sees have to be in the segment files
+	if err := db.flush(); err != nil {
+		return &iterator{err: err, released: true}
+	}
+	it := &iterator{db: db, segments: make(map[uint32]*segment, len(db.segments))}
+	for id, seg := range db.segments {
+		seg.refs++
+		it.segments[id] = seg
+	}
+	it.next, it.stop = iter.Pull2(db.kvEntries.Clone().Ascend(bounds(prefix, start)))
+	return it
+}
+
+// bounds returns the range of keys with prefix that are at or after prefix+start.
+func bounds(prefix []byte, start []byte) (btreemap.LowerBound[string], btreemap.UpperBound[string]) {
+	lower := btreemap.GE(string(prefix) + string(start))
+	if limit := upperBound(prefix); limit != nil {
+		return lower, btreemap.LT(string(limit))
+	}
+	return lower, btreemap.Max[string]()
+}
+
+// upperBound returns the upper bound for the given prefix
+func upperBound(prefix []byte) (limit []byte) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		c := prefix[i]
+		if c == 0xff {
+			continue
+		}
+		limit = make([]byte, i+1)
+		copy(limit, prefix)
+		limit[i] = c + 1
+		break
+	}
+	return limit
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (it *iterator) Next() bool {
+	if it.err != nil || it.released {
+		return false
+	}
+	key, e, ok := it.next()
+	if !ok {
+		it.key, it.value = nil, nil
+		return false
+	}
+	value := make([]byte, e.valueSize)
+	n, err := it.segments[e.segment].f.ReadAt(value, e.valueOff)
+	if err == nil && n != e.valueSize {
+		err = errors.New("full read failed")
+	}
+	if err != nil {
+		it.key, it.value, it.err = nil, nil, err
+		return false
+	}
+	it.key, it.value = []byte(key), value
+	return true
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (it *iterator) Error() error {
+	return it.err
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (it *iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (it *iterator) Value() []byte {
+	return it.value
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (it *iterator) Release() {
+	if it.released {
+		return
+	}
+	it.released = true
+	it.stop()
+	it.key, it.value = nil, nil
+
+	db := it.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, seg := range it.segments {
+		seg.refs--
+	}
+	if db.closed {
+		return
+	}
+	if err := db.removeObsolete(); err != nil {
+		log.Printf("simple_db: deleting compacted segments of %s failed: %v", db.path, err)
+	}
+}
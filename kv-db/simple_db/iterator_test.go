@@ -0,0 +1,185 @@
+package simple_db
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// collect returns the keys and values of it, in order, and releases it.
+func collect(t *testing.T, it ethdb.Iterator) ([]string, map[string]string) {
+	t.Helper()
+	defer it.Release()
+	var keys []string
+	kvs := make(map[string]string)
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+		kvs[string(it.Key())] = string(it.Value())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return keys, kvs
+}
+
+// expected returns the keys of kvs with prefix at or after prefix+start, in order.
+func expected(kvs map[string]string, prefix, start string) []string {
+	var keys []string
+	for k := range kvs {
+		if strings.HasPrefix(k, prefix) && k >= prefix+start {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIteratorBounds(t *testing.T) {
+	opts := DefaultOptions
+	opts.SegmentSize = 512
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvs := make(map[string]string)
+	for _, k := range []string{"", "a", "a\x00", "ab", "abc", "ac", "b", "b\xff", "b\xff\xff", "c\xff", "d"} {
+		if err := db.Put([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[k] = "v" + k
+	}
+	for _, c := range []struct{ prefix, start string }{
+		{"", ""}, {"a", ""}, {"a", "b"}, {"a", "bd"}, {"ab", ""}, {"", "ab"}, {"b\xff", ""}, {"c\xff", ""},
+		{"", "zz"}, {"x", ""}, {"a", "\x00"},
+	} {
+		keys, values := collect(t, db.NewIterator([]byte(c.prefix), []byte(c.start)))
+		want := expected(kvs, c.prefix, c.start)
+		if fmt.Sprint(keys) != fmt.Sprint(want) {
+			t.Fatalf("prefix %q start %q: got %q, want %q", c.prefix, c.start, keys, want)
+		}
+		for k, v := range values {
+			if kvs[k] != v {
+				t.Fatalf("key %q: got %q, want %q", k, v, kvs[k])
+			}
+		}
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	db, err := NewDatabaseWithOptions(t.TempDir(), DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvs := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Put([]byte(key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		kvs[key] = "old"
+	}
+	it := db.NewIterator(nil, nil)
+	// writes after NewIterator aren't seen, neither before nor after the iterator passes their keys
+	if !it.Next() {
+		t.Fatal("iterator is empty")
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%2 == 0 {
+			if err := db.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := db.Put([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("key5a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{string(it.Key())}
+	for it.Next() {
+		if string(it.Value()) != "old" {
+			t.Fatalf("key %s: got %q after the iterator was created", it.Key(), it.Value())
+		}
+		keys = append(keys, string(it.Key()))
+	}
+	it.Release()
+	if want := expected(kvs, "", ""); fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", keys, want)
+	}
+}
+
+func TestIteratorAcrossCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	opts.SegmentSize = 256
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kvs := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			key, value := fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d-%d", i, round)
+			if err := db.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = value
+		}
+	}
+	// compaction takes every segment, the active one included
+	db.lock.Lock()
+	var inputs []uint32
+	for id := range db.segments {
+		inputs = append(inputs, id)
+	}
+	db.lock.Unlock()
+
+	it := db.NewIterator(nil, nil)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// the compacted segments are obsolete but stay on disk for the iterator
+	for _, id := range inputs {
+		if _, err := os.Stat(segmentPath(dir, id)); err != nil {
+			t.Fatalf("segment %d read by an iterator was deleted: %v", id, err)
+		}
+	}
+	db.lock.Lock()
+	obsolete := len(db.obsolete)
+	db.lock.Unlock()
+	if obsolete != len(inputs) {
+		t.Fatalf("%d obsolete segments, want %d", obsolete, len(inputs))
+	}
+	keys, values := collect(t, it)
+	if want := expected(kvs, "", ""); fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", keys, want)
+	}
+	for k, v := range values {
+		if kvs[k] != v {
+			t.Fatalf("key %s: got %q, want %q", k, v, kvs[k])
+		}
+	}
+	// Release deleted them
+	for _, id := range inputs {
+		if _, err := os.Stat(segmentPath(dir, id)); !os.IsNotExist(err) {
+			t.Fatalf("obsolete segment %d is still there after Release: %v", id, err)
+		}
+	}
+	db.lock.Lock()
+	obsolete = len(db.obsolete)
+	db.lock.Unlock()
+	if obsolete != 0 {
+		t.Fatalf("%d obsolete segments after Release", obsolete)
+	}
+	checkState(t, db, kvs)
+}
@@ -0,0 +1,252 @@
+package simple_db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RaduBerinde/btreemap"
+)
+
+// RecoveryReport describes what opening the database found.
+type RecoveryReport struct {
+	Segments       int
+	HintedSegments int   // segments indexed from their hint file
+	Records        int64 // records replayed from segment files
+	Truncated      []Truncation
+}
+
+// Truncation is a torn or corrupt segment tail that was cut off.
+type Truncation struct {
+	Segment uint32
+	Offset  int64
+	Dropped int64
+	Reason  string
+}
+
+// Recovery returns the report of opening the database.
+func (db *Database) Recovery() RecoveryReport {
+	return db.recovery
+}
+
+const (
+	segmentSuffix = ".data"
+	tmpSuffix     = ".tmp"
+)
+
+func segmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d%s", id, segmentSuffix))
+}
+
+func NewDatabaseWithOptions(path string, opts Options) (*Database, error) {
+	if opts.HashedKeys && opts.SegmentSize > maxHashedSegment {
+		return nil, fmt.Errorf("segment size %d too large for the hashed index, at most %d", opts.SegmentSize, maxHashedSegment)
+	}
+	// databases before segments were a single file at path, their records have no checksums and can't be replayed
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is a single-file database of an older format, recreate it as a segment directory", path)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("%s is not a segment directory: %w", path, err)
+	}
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	hints := make(map[uint32]bool)
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			// a compaction output or hint that wasn't finished, what it replaces is still there
+			if err := os.Remove(filepath.Join(path, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var id uint32
+		if _, err := fmt.Sscanf(name, "%09d"+hintSuffix, &id); err == nil {
+			hints[id] = true
+		} else if _, err := fmt.Sscanf(name, "%09d"+segmentSuffix, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		delete(hints, id)
+	}
+	// hints of segments that compaction deleted
+	for id := range hints {
+		if err := os.Remove(hintPath(path, id)); err != nil {
+			return nil, err
+		}
+	}
+
+	db := &Database{
+		path:     path,
+		opts:     opts,
+		segments: make(map[uint32]*segment),
+		nextID:   1,
+	}
+	if opts.HashedKeys {
+		db.hashed = newHashIndex(opts.ExpectedKeys, db.recordHasKey)
+	} else {
+		db.kvEntries = btreemap.New[string, valueEntry](32, strings.Compare)
+	}
+	if opts.CacheSize > 0 {
+		db.cache = newValueCache(opts.CacheSize)
+	}
+	// later segments overwrite earlier ones
+	for i, id := range ids {
+		f, err := os.OpenFile(segmentPath(path, id), os.O_RDWR, 0666)
+		if err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+		seg := &segment{id: id, f: f}
+		db.segments[id] = seg
+		// the last segment stays active, its hint entries are kept to rewrite the hint on rollover or Close
+		var hint *[]byte
+		if i == len(ids)-1 {
+			hint = &db.hintBuf
+		}
+		if err := db.replay(seg, hint); err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+		db.active = seg
+		db.nextID = id + 1
+	}
+	db.recovery.Segments = len(ids)
+	if db.active == nil || db.active.size >= opts.SegmentSize {
+		if err := db.rollover(); err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+	}
+	if opts.Durability == SyncInterval {
+		db.done = make(chan struct{})
+		db.syncWg.Add(1)
+		go db.syncLoop()
+	}
+	return db, nil
+}
+
+func (db *Database) createSegment(id uint32) (*segment, error) {
+	f, err := os.OpenFile(segmentPath(db.path, id), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, f: f}, nil
+}
+
+func (db *Database) closeSegments() {
+	for _, seg := range db.segments {
+		seg.f.Close()
+	}
+}
+
+// replay indexes the records of seg from its hint, and the records the hint doesn't cover from seg.
+// The first record that is incomplete or fails its checksum is where a crash tore the segment, it is truncated there.
+// The hint entries of all records are appended to hint if it isn't nil.
+func (db *Database) replay(seg *segment, hint *[]byte) error {
+	stat, err := seg.f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = stat.Size()
+	off, err := db.loadHint(seg, hint)
+	if err != nil {
+		return err
+	}
+	if off == 0 && hint != nil {
+		*hint = nil
+	}
+	if off > 0 {
+		db.recovery.HintedSegments++
+	}
+	reader := bufio.NewReader(io.NewSectionReader(seg.f, off, seg.size-off))
+	data := make([]byte, headerSize)
+	var record []byte
+	for off < seg.size {
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return db.truncate(seg, off, "incomplete header")
+		}
+		keySize := binary.BigEndian.Uint32(data[4:])
+		valueSize := binary.BigEndian.Uint64(data[8:])
+		tombstone := keySize&tombstoneFlag != 0
+		batch := keySize&batchFlag != 0
+		keySize &^= tombstoneFlag | batchFlag
+		if valueSize > uint64(seg.size-off) || recordSize(int(keySize), int(valueSize)) > seg.size-off {
+			return db.truncate(seg, off, "incomplete record")
+		}
+		n := int(recordSize(int(keySize), int(valueSize)))
+		if cap(record) < n {
+			record = make([]byte, n)
+		}
+		record = record[:n]
+		copy(record, data)
+		if _, err := io.ReadFull(reader, record[headerSize:]); err != nil {
+			return db.truncate(seg, off, "incomplete record")
+		}
+		if crc32.Checksum(record[4:], crcTable) != binary.BigEndian.Uint32(record) {
+			return db.truncate(seg, off, "checksum mismatch")
+		}
+		if batch {
+			// a malformed batch is dropped as a whole
+			if err := walkBatch(off, record[headerSize:], nil); err != nil {
+				return db.truncate(seg, off, err.Error())
+			}
+			if err := db.replayBatch(seg, off, record[headerSize:], hint); err != nil {
+				return err
+			}
+		} else {
+			key := record[headerSize : headerSize+keySize]
+			valueOff := off + headerSize + int64(keySize)
+			if err := db.apply(seg, key, int(valueSize), valueOff, tombstone); err != nil {
+				return err
+			}
+			if hint != nil {
+				*hint = appendHint(*hint, key, int(valueSize), valueOff, tombstone)
+			}
+		}
+		db.recovery.Records++
+		off += int64(n)
+	}
+	return nil
+}
+
+// truncate drops everything of seg from off on.
+func (db *Database) truncate(seg *segment, off int64, reason string) error {
+	db.recovery.Truncated = append(db.recovery.Truncated, Truncation{
+		Segment: seg.id,
+		Offset:  off,
+		Dropped: seg.size - off,
+		Reason:  reason,
+	})
+	log.Printf("simple_db: truncating segment %d of %s at %d, dropping %d bytes: %s", seg.id, db.path, off, seg.size-off, reason)
+	if err := seg.f.Truncate(off); err != nil {
+		return err
+	}
+	seg.size = off
+	return seg.f.Sync()
+}
+
+// apply indexes a replayed record of seg.
+func (db *Database) apply(seg *segment, key []byte, valueSize int, valueOff int64, tombstone bool) error {
+	if tombstone {
+		return db.unindex(string(key))
+	}
+	return db.index(string(key), valueEntry{
+		segment:   seg.id,
+		valueOff:  valueOff,
+		valueSize: valueSize,
+	})
+}
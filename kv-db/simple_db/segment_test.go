@@ -0,0 +1,73 @@
+package simple_db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRolloverAtSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions
+	opts.SegmentSize = 1024
+	opts.CompactionRatio = 0
+	db, err := NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs := make(map[string]string)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		kvs[key] = value
+	}
+	// a segment rolls over with the record that reaches SegmentSize, so it is less than a record larger
+	maxSize := opts.SegmentSize + recordSize(len("key000"), len(value))
+	db.lock.Lock()
+	segments := len(db.segments)
+	for _, seg := range db.segments {
+		if seg.size >= maxSize || seg != db.active && seg.size < opts.SegmentSize {
+			t.Errorf("segment %d has %d bytes with a segment size of %d", seg.id, seg.size, opts.SegmentSize)
+		}
+	}
+	db.lock.Unlock()
+	if want := int(100*recordSize(len("key000"), len(value))/opts.SegmentSize) + 1; segments != want {
+		t.Fatalf("%d segments, want %d", segments, want)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != segments {
+		t.Fatalf("%d segment files, want %d", len(names), segments)
+	}
+	db, err = NewDatabaseWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if r := db.Recovery(); r.Segments != segments {
+		t.Fatalf("opened %d segments, want %d", r.Segments, segments)
+	}
+	checkState(t, db, kvs)
+}
+
+func TestOpenSingleFileDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench_simple")
+	if err := os.WriteFile(path, []byte{0, 0, 0, 2, 0, 0, 0, 1, 'k', 'v'}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewDatabaseWithOptions(path, DefaultOptions)
+	if err == nil || !strings.Contains(err.Error(), "single-file database") {
+		t.Fatalf("opening a single-file database: %v", err)
+	}
+}